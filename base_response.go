@@ -14,6 +14,19 @@ const (
 	optTooOften         Ret = 1205 // operate too often
 )
 
+// 导出的 Ret, 可以使用 errors.Is 判断接口返回的错误, 如 errors.Is(err, openwechat.RetCookieInvalid)
+const (
+	RetTicketError         = ticketError
+	RetLogicError          = logicError
+	RetSysError            = sysError
+	RetParamError          = paramError
+	RetFailedLoginWarn     = failedLoginWarn
+	RetFailedLoginCheck    = failedLoginCheck
+	RetCookieInvalid       = cookieInvalid
+	RetLoginEnvAbnormality = loginEnvAbnormality
+	RetOptTooOften         = optTooOften
+)
+
 // BaseResponse 大部分返回对象都携带该信息
 type BaseResponse struct {
 	Ret    Ret
@@ -24,9 +37,10 @@ func (b BaseResponse) Ok() bool {
 	return b.Ret == 0
 }
 
+// Err 返回 *APIError, 通过 Caller 调用时会带上接口名称和 HTTP 状态码
 func (b BaseResponse) Err() error {
 	if b.Ok() {
 		return nil
 	}
-	return b.Ret
+	return &APIError{Ret: b.Ret, ErrMsg: b.ErrMsg}
 }
@@ -10,6 +10,9 @@ import (
 	"net/url"
 	"os/exec"
 	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Bot struct {
@@ -17,12 +20,14 @@ type Bot struct {
 	LoginCallBack       func(body CheckLoginResponse) // 登陆回调
 	LogoutCallBack      func(bot *Bot)                // 退出回调
 	UUIDCallback        func(uuid string)             // 获取UUID的回调函数
+	UUIDExpiredCallback func(uuid string)             // 登录二维码过期的回调函数
 	SyncCheckCallback   func(resp SyncCheckResponse)  // 心跳回调
 	MessageHandler      MessageHandler                // 获取消息成功的handle
 	MessageErrorHandler MessageErrorHandler           // 获取消息发生错误的handle, 返回err == nil 则尝试继续监听
 	Caller              *Caller
 	Storage             *Session
 	err                 error
+	errMu               sync.Mutex // 保护 err, 消息同步和用户可能同时退出
 	context             context.Context
 	cancel              func()
 	self                *Self
@@ -31,6 +36,22 @@ type Bot struct {
 	loginUUID           string
 	deviceId            string // 设备Id
 	loginOptionGroup    BotOptionGroup
+	prepareErr          error // BotPreparer 无法完成设置时的错误, 登录时返回
+	// 二维码过期后的自动刷新策略
+	qrcodeRefreshCount    int
+	qrcodeRefreshDeadline time.Time
+	hotReloadMaxAge       time.Duration // 热存储数据的有效期, 为零时不检查
+	sessionRefresher      *SessionRefresher
+	reconnector           *Reconnector
+	domainFailover        *DomainFailover
+	sessionLease          *SessionLease
+	syncDrainLimit        int // 一次同步检查之后最多连续调用 webwxsync 的次数, 为零时为 defaultSyncDrainLimit
+	deduplicator          *MessageDeduplicator
+	events                eventBus
+	loginTime             atomic.Int64 // 最近一次登录成功的时间, unix 纳秒
+	lastSyncTime          atomic.Int64 // 最近一次同步检查成功的时间, unix 纳秒
+	syncing               atomic.Bool  // 消息同步是否正在运行
+	exited                atomic.Bool  // 是否通过 Exit 退出
 }
 
 // Alive 判断当前用户是否正常在线
@@ -61,10 +82,17 @@ func (b *Bot) GetCurrentUser() (*Self, error) {
 func (b *Bot) login(login BotLogin) (err error) {
 	opt := b.loginOptionGroup
 	opt.Prepare(b)
+	if b.prepareErr != nil {
+		return b.prepareErr
+	}
 	if err = login.Login(b); err != nil {
 		err = opt.OnError(b, err)
 	}
 	if err != nil {
+		// 没有登录成功时释放会话租约, 让其他进程可以使用这份热存储数据
+		if lease := b.sessionLease; lease != nil && b.self == nil {
+			_ = lease.Release()
+		}
 		return err
 	}
 	return opt.OnSuccess(b)
@@ -72,8 +100,16 @@ func (b *Bot) login(login BotLogin) (err error) {
 
 // Login 用户登录
 func (b *Bot) Login() error {
-	scanLogin := &ScanLogin{UUID: b.loginUUID}
-	return b.login(scanLogin)
+	return b.login(b.scanLogin())
+}
+
+// scanLogin 根据 Bot 的设置创建一个扫码登录的 BotLogin
+func (b *Bot) scanLogin() *ScanLogin {
+	return &ScanLogin{
+		UUID:            b.loginUUID,
+		MaxRefreshCount: b.qrcodeRefreshCount,
+		Deadline:        b.qrcodeRefreshDeadline,
+	}
 }
 
 // HotLogin 热登录,可实现在单位时间内免重复扫码登录
@@ -86,6 +122,12 @@ func (b *Bot) HotLogin(storage HotReloadStorage, opts ...BotLoginOption) error {
 	return b.login(hotLogin)
 }
 
+// LoginWith 使用指定的登录方式登录, 如 ChainLogin
+func (b *Bot) LoginWith(login BotLogin, opts ...BotLoginOption) error {
+	b.loginOptionGroup = opts
+	return b.login(login)
+}
+
 // PushLogin 免扫码登录
 // 免扫码登录需要先扫码登录一次才可以进行扫码登录
 func (b *Bot) PushLogin(storage HotReloadStorage, opts ...BotLoginOption) error {
@@ -109,9 +151,9 @@ func (b *Bot) Logout() error {
 }
 
 // loginFromURL 登录逻辑
-func (b *Bot) loginFromURL(path *url.URL) error {
+func (b *Bot) loginFromURL(ctx context.Context, path *url.URL) error {
 	// 获取登录的一些基本的信息
-	info, err := b.Caller.GetLoginInfo(b.Context(), path)
+	info, err := b.Caller.GetLoginInfo(ctx, path)
 	if err != nil {
 		return err
 	}
@@ -134,7 +176,7 @@ func (b *Bot) loginFromURL(path *url.URL) error {
 	// 将BaseRequest存到storage里面方便后续调用
 	b.Storage.Request = request
 
-	return b.webInit()
+	return b.webInit(ctx)
 }
 
 func (b *Bot) initContacts(resp *WebInitResponse) {
@@ -151,8 +193,8 @@ func (b *Bot) updateSyncKey(resp *WebInitResponse) {
 }
 
 // 拆分为小函数
-func (b *Bot) initUserInfo() error {
-	resp, err := b.Caller.WebInit(b.Context(), b.Storage.Request)
+func (b *Bot) initUserInfo(ctx context.Context) error {
+	resp, err := b.Caller.WebInit(ctx, b.Storage.Request)
 	if err != nil {
 		return err
 	}
@@ -180,28 +222,57 @@ func (b *Bot) saveHotReloadData() error {
 	return b.DumpHotReloadStorage()
 }
 
-func (b *Bot) notifyMobileClient() error {
+func (b *Bot) notifyMobileClient(ctx context.Context) error {
 	notifyOption := &CallerWebWxStatusNotifyOptions{
 		BaseRequest:     b.Storage.Request,
 		WebInitResponse: b.Storage.Response,
 		LoginInfo:       b.Storage.LoginInfo,
 	}
-	return b.Caller.WebWxStatusNotify(b.Context(), notifyOption)
+	return b.Caller.WebWxStatusNotify(ctx, notifyOption)
 }
 
+// startMessageSync 启动消息同步, 已经在同步时不会重复启动, 如刷新会话之后
 func (b *Bot) startMessageSync() {
-	go b.runMessageLoop()
+	if b.syncing.CompareAndSwap(false, true) {
+		go b.runMessageLoop()
+		return
+	}
+	// 刷新会话和重新登录都在消息同步的 goroutine 中进行, Self 已经被替换, 重新加载比较联系人变更的基准
+	b.loadContactsForEvents()
 }
 
 func (b *Bot) runMessageLoop() {
+	defer b.syncing.Store(false)
 	b.initMessageErrorHandler()
+	b.loadContactsForEvents()
 
 	for b.Alive() {
 		if err := b.syncCheck(); err != nil {
-			if err = b.handleSyncError(err); err != nil {
-				b.ExitWith(err)
+			// context 已经被取消, 错误只是取消导致的, 退出原因由 CrashReason 给出
+			if b.Context().Err() != nil {
 				return
 			}
+			// 连续的网络错误先尝试切换到其他域名
+			if f := b.domainFailover; f != nil && f.failed(b, err) {
+				continue
+			}
+			// 网络长时间中断时尝试重新登录
+			if r := b.reconnector; r != nil && r.outage(b, err) {
+				if err = r.reconnect(b, err); err != nil {
+					b.ExitWith(err)
+					return
+				}
+				continue
+			}
+			if err = b.handleSyncError(err); err != nil {
+				if r := b.reconnector; r != nil && r.recoverable(err) {
+					err = r.reconnect(b, err)
+				}
+				if err != nil {
+					b.ExitWith(err)
+					return
+				}
+			}
 		}
 	}
 }
@@ -216,9 +287,10 @@ func (b *Bot) handleSyncError(err error) error {
 	return b.MessageErrorHandler(err)
 }
 
-func (b *Bot) webInit() error {
+// webInit 登录成功之后的初始化, 请求使用登录过程的 ctx
+func (b *Bot) webInit(ctx context.Context) error {
 	// 1. 初始化用户信息
-	if err := b.initUserInfo(); err != nil {
+	if err := b.initUserInfo(ctx); err != nil {
 		return fmt.Errorf("init user info: %w", err)
 	}
 
@@ -228,10 +300,13 @@ func (b *Bot) webInit() error {
 	}
 
 	// 3. 通知移动端
-	if err := b.notifyMobileClient(); err != nil {
+	if err := b.notifyMobileClient(ctx); err != nil {
 		return fmt.Errorf("notify mobile client: %w", err)
 	}
 
+	b.loginTime.Store(time.Now().UnixNano())
+	b.publish(&Event{Type: EventLogin})
+
 	// 4. 启动消息同步
 	b.startMessageSync()
 
@@ -239,38 +314,76 @@ func (b *Bot) webInit() error {
 }
 
 func (b *Bot) executeSyncCallback(resp *SyncCheckResponse) {
-	if b.SyncCheckCallback != nil {
-		b.SyncCheckCallback(*resp)
-	}
+	b.publish(&Event{Type: EventSyncCheck, SyncCheck: resp})
 }
 
 func (b *Bot) handleMessages(messages []*Message) {
-	if b.MessageHandler == nil {
-		return
-	}
-
 	for _, msg := range messages {
+		// 过滤重连或者热登录之后重复推送的消息
+		if d := b.deduplicator; d != nil && d.Duplicate(msg) {
+			continue
+		}
 		msg.init(b)
-		b.MessageHandler(msg)
+		b.publish(&Event{Type: EventMessage, Message: msg})
 	}
 }
 
+// defaultSyncDrainLimit 一次同步检查之后默认最多连续调用 webwxsync 的次数
+const defaultSyncDrainLimit = 10
+
+// SyncBacklog 记录了一次同步检查之后因为 ContinueFlag 连续调用 webwxsync 拉取的数据
+type SyncBacklog struct {
+	Rounds   int // 调用 webwxsync 的次数
+	Messages int // 拉取到的消息数量
+	Contacts int // 拉取到的联系人变更数量
+	// Remaining 达到次数上限时服务端依然有未拉取的数据, 剩下的数据会在下一次同步检查之后继续拉取
+	Remaining bool
+}
+
+// processNewMessages 拉取新消息, 服务端设置了 ContinueFlag 时继续拉取, 直到没有积压或者达到次数上限
+// 每一轮拉取到的消息都会立即处理, 并且保存 SyncKey, 中途退出时不会重复拉取已经处理的消息
 func (b *Bot) processNewMessages() error {
-	// 获取新消息
-	messages, err := b.syncMessage()
-	if err != nil {
-		return fmt.Errorf("sync message failed: %w", err)
+	limit := b.syncDrainLimit
+	if limit <= 0 {
+		limit = defaultSyncDrainLimit
+	}
+	// 这一次同步检查处理完之后写入一次去重的记录
+	if d := b.deduplicator; d != nil {
+		defer func() { _ = d.Flush() }()
 	}
+	var backlog SyncBacklog
+	for b.Alive() {
+		// 获取新消息
+		resp, err := b.syncMessage()
+		if err != nil {
+			return fmt.Errorf("sync message failed: %w", err)
+		}
+		backlog.Rounds++
+		backlog.Messages += len(resp.AddMsgList)
+		backlog.Contacts += len(resp.ModContactList) + len(resp.DelContactList) + len(resp.ModChatRoomMemberList)
 
-	// 保存热重载数据
-	_ = b.DumpHotReloadStorage()
+		// 保存热重载数据
+		_ = b.DumpHotReloadStorage()
 
-	// 处理消息
-	b.handleMessages(messages)
+		// 处理消息
+		b.handleMessages(resp.AddMsgList)
 
+		if resp.ContinueFlag == 0 {
+			break
+		}
+		if backlog.Rounds >= limit {
+			backlog.Remaining = true
+			break
+		}
+	}
+	// 有积压时通知积压的大小
+	if backlog.Rounds > 1 {
+		b.publish(&Event{Type: EventSyncBacklog, Backlog: &backlog})
+	}
 	return nil
 }
 
+// handleSyncSelector 新消息和联系人变更都需要通过 webwxsync 获取, 联系人变更会转换成 ContactEvent
 func (b *Bot) handleSyncSelector(selector Selector) error {
 	switch selector {
 	case SelectorNormal:
@@ -297,6 +410,7 @@ func (b *Bot) doSyncCheck(option *CallerSyncCheckOptions) error {
 	if err := resp.Err(); err != nil {
 		return resp.Err()
 	}
+	b.lastSyncTime.Store(time.Now().UnixNano())
 
 	// 处理消息
 	return b.handleSyncSelector(resp.Selector)
@@ -314,6 +428,10 @@ func (b *Bot) syncCheck() error {
 	option := &CallerSyncCheckOptions{}
 
 	for b.Alive() {
+		// 会话即将过期时主动刷新
+		if b.sessionRefresher != nil {
+			b.sessionRefresher.refresh(b)
+		}
 		if err := b.doSyncCheck(option); err != nil {
 			return err
 		}
@@ -322,7 +440,7 @@ func (b *Bot) syncCheck() error {
 }
 
 // 获取新的消息
-func (b *Bot) syncMessage() ([]*Message, error) {
+func (b *Bot) syncMessage() (*WebWxSyncResponse, error) {
 	opt := CallerWebWxSyncOptions{
 		BaseRequest:     b.Storage.Request,
 		WebInitResponse: b.Storage.Response,
@@ -337,10 +455,18 @@ func (b *Bot) syncMessage() ([]*Message, error) {
 	if resp.SyncKey.Count > 0 {
 		b.Storage.Response.SyncKey = resp.SyncKey
 	}
-	return resp.AddMsgList, nil
+
+	// 更新联系人缓存并且通知联系人变更
+	if self := b.self; self != nil {
+		for _, event := range self.applyContactChanges(resp) {
+			b.publish(&Event{Type: EventContact, Contact: event})
+		}
+	}
+	return resp, nil
 }
 
 // Block 当消息同步发生了错误或者用户主动在手机上退出，该方法会立即返回，否则会一直阻塞
+// 返回值与 CrashReason 相同, 可以通过 *ExitReason 判断退出的原因
 func (b *Bot) Block() error {
 	if b.self == nil {
 		return errors.New("`Block` must be called after user login")
@@ -350,23 +476,42 @@ func (b *Bot) Block() error {
 }
 
 // Exit 主动退出，让 Block 不在阻塞
+// 没有其他事件正在投递时, 返回之前会调用 LogoutCallBack 和 EventExit 的订阅者, 见 Subscribe
 func (b *Bot) Exit() {
 	b.self = nil
+	first := b.exited.CompareAndSwap(false, true)
 	b.cancel()
-	if b.LogoutCallBack != nil {
-		b.LogoutCallBack(b)
+	// 同时退出时只通知一次
+	// 可能在处理函数中调用, 不能等待正在进行的投递
+	if first {
+		b.tryPublish(&Event{Type: EventExit, Err: b.CrashReason()})
 	}
 }
 
 // ExitWith 主动退出并且设置退出原因, 可以通过 `CrashReason` 获取退出原因
+// err 会被包装成 *ExitReason
 func (b *Bot) ExitWith(err error) {
-	b.err = err
+	b.errMu.Lock()
+	b.err = nil
+	if err != nil {
+		b.err = newExitReason(err)
+	}
+	b.errMu.Unlock()
 	b.Exit()
 }
 
-// CrashReason 获取当前Bot崩溃的原因
+// CrashReason 获取当前Bot崩溃的原因, 不为 nil 时是一个 *ExitReason
+// 调用 Exit 退出时为 nil, 外部的 context 被取消时为 ExitContextCanceled
 func (b *Bot) CrashReason() error {
-	return b.err
+	b.errMu.Lock()
+	defer b.errMu.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+	if err := b.context.Err(); err != nil && !b.exited.Load() {
+		return &ExitReason{Kind: ExitContextCanceled, Err: err}
+	}
+	return nil
 }
 
 // DumpHotReloadStorage 写入HotReloadStorage
@@ -385,11 +530,34 @@ func (b *Bot) DumpTo(writer io.Writer) error {
 		BaseRequest:  b.Storage.Request,
 		Jar:          jar,
 		LoginInfo:    b.Storage.LoginInfo,
-		WechatDomain: b.Caller.Client.Domain,
+		WechatDomain: b.Caller.Client.Domain(),
 		SyncKey:      b.Storage.Response.SyncKey,
 		UUID:         b.uuid,
 	}
-	return json.NewEncoder(writer).Encode(item)
+	envelope, err := newHotReloadEnvelope(b, item)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(writer).Encode(envelope)
+}
+
+// SessionInfo 返回当前会话的健康状况
+func (b *Bot) SessionInfo() SessionInfo {
+	jar := b.Caller.Client.Jar()
+	_, hasDataTicket := jar.AllCookies().GetByName("webwx_data_ticket")
+	return SessionInfo{
+		LoginTime:      unixNanoTime(b.loginTime.Load()),
+		LastSyncTime:   unixNanoTime(b.lastSyncTime.Load()),
+		CookieExpiries: jar.Expiries(),
+		HasDataTicket:  hasDataTicket,
+	}
+}
+
+func unixNanoTime(nano int64) time.Time {
+	if nano == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nano)
 }
 
 // IsHot returns true if is hot login otherwise false
@@ -414,12 +582,16 @@ func NewBot(c context.Context) *Bot {
 	// 默认行为为网页版微信模式
 	caller.Client.SetMode(normal)
 	ctx, cancel := context.WithCancel(c)
-	return &Bot{
-		Caller:  caller,
-		Storage: &Session{},
-		context: ctx,
-		cancel:  cancel,
-	}
+	bot := &Bot{
+		Caller:       caller,
+		Storage:      &Session{},
+		context:      ctx,
+		cancel:       cancel,
+		deduplicator: NewMessageDeduplicator(0, 0),
+	}
+	// 回调字段是事件的第一个订阅者
+	bot.events.subscribe(bot.dispatchCallbacks)
+	return bot
 }
 
 func New(ctx context.Context) *Bot {
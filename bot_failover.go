@@ -0,0 +1,93 @@
+package openwechat
+
+import (
+	"sync"
+	"time"
+)
+
+// DomainFailover 在消息同步连续发生网络错误之后, 探测其他的微信域名并切换到可用的域名
+// 切换之后会保存热存储数据, 下次热登录时直接使用可用的域名
+// DomainFailover 记录了一个 Bot 的失败次数, 每个 Bot 需要使用单独的 DomainFailover
+type DomainFailover struct {
+	// MaxFailures 连续发生多少次网络错误之后开始探测, 为零时为 3
+	MaxFailures int
+
+	// Domains 候选的域名, 为空时使用当前域名的 Alternatives
+	Domains []WechatDomain
+
+	// OnSwitch 切换域名之后的回调
+	OnSwitch func(from, to WechatDomain)
+
+	mu          sync.Mutex
+	failures    int
+	lastFailure time.Time
+}
+
+func (f *DomainFailover) maxFailures() int {
+	if f.MaxFailures > 0 {
+		return f.MaxFailures
+	}
+	return 3
+}
+
+// failed 记录一次同步检查的错误, 返回是否切换到了其他域名
+func (f *DomainFailover) failed(bot *Bot, err error) bool {
+	if !IsNetworkError(err) || !f.reachedMaxFailures(bot) {
+		return false
+	}
+	return f.switchDomain(bot)
+}
+
+// reachedMaxFailures 记录一次网络错误, 返回是否达到了开始探测的次数
+func (f *DomainFailover) reachedMaxFailures(bot *Bot) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// 上次失败之后同步检查成功过, 重新计数
+	if bot.SessionInfo().LastSyncTime.After(f.lastFailure) {
+		f.failures = 0
+	}
+	f.failures++
+	f.lastFailure = time.Now()
+	if f.failures < f.maxFailures() {
+		return false
+	}
+	f.failures = 0
+	return true
+}
+
+// switchDomain 依次探测候选的域名, 切换到第一个同步检查成功的域名
+// 探测和切换之后的请求一样带上当前会话的 cookie, 否则微信会拒绝同步检查
+func (f *DomainFailover) switchDomain(bot *Bot) bool {
+	current := bot.Caller.Client.Domain()
+	candidates := f.Domains
+	if len(candidates) == 0 {
+		candidates = current.Alternatives()
+	}
+	option := &CallerSyncCheckOptions{}
+	bot.updateSyncCheckOptions(option)
+	for _, domain := range candidates {
+		if domain == current {
+			continue
+		}
+		// 在临时的 cookiejar 中带上当前会话的 cookie 进行探测, 探测失败时不会留下无用的 cookie
+		jar := bot.Caller.Client.Jar().clone()
+		jar.copyDomain(current, domain)
+		resp, err := bot.probeCaller(jar, domain).ProbeDomain(bot.Context(), domain, option)
+		if err != nil || !resp.Success() {
+			continue
+		}
+		bot.Caller.Client.Jar().copyDomain(current, domain)
+		bot.Caller.Client.SetDomain(domain)
+		_ = bot.saveHotReloadData()
+		if f.OnSwitch != nil {
+			f.OnSwitch(current, domain)
+		}
+		return true
+	}
+	return false
+}
+
+// WithDomainFailover 是一个 BotPreparerFunc，用于开启消息同步网络错误时的域名切换
+func WithDomainFailover(failover *DomainFailover) BotPreparer {
+	return BotPreparerFunc(func(b *Bot) { b.domainFailover = failover })
+}
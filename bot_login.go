@@ -2,8 +2,10 @@ package openwechat
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"time"
 )
 
 // LoginCode 定义登录状态码
@@ -102,7 +104,8 @@ type RetryLoginOption struct {
 // OnError 实现了 BotLoginOption 接口
 // 当登录失败后，会调用此方法进行扫码登录
 func (r *RetryLoginOption) OnError(bot *Bot, err error) error {
-	if r.currentRetryTime >= r.MaxRetryCount {
+	// 会话被其他进程持有时扫码登录会把对方挤下线
+	if r.currentRetryTime >= r.MaxRetryCount || errors.Is(err, ErrSessionLocked) {
 		return err
 	}
 	r.currentRetryTime++
@@ -113,24 +116,120 @@ func NewRetryLoginOption() BotLoginOption {
 	return &RetryLoginOption{MaxRetryCount: 1}
 }
 
+// ModeFallbackOption 在网页版模式下登录环境异常或者被禁止登录时, 切换到桌面模式重新扫码登录
+//
+//	fallback := openwechat.NewModeFallbackOption()
+//	err := bot.HotLogin(storage, openwechat.NewRetryLoginOption(), fallback)
+//	log.Println("login with", fallback.ModeName())
+type ModeFallbackOption struct {
+	BaseBotLoginOption
+
+	// Fallback 切换之后使用的模式, 为空时使用桌面模式
+	Fallback Mode
+
+	// OnFallback 切换模式之前的回调, err 为导致切换的错误
+	OnFallback func(err error)
+
+	fellBack    bool
+	fallingBack bool
+	mode        Mode
+	modeName    string
+}
+
+// Prepare 实现了 BotLoginOption 接口, 每次登录之前重置切换的状态
+// 切换模式之后重新登录时也会调用 Prepare, 这时不能重置, 否则会再次切换
+func (m *ModeFallbackOption) Prepare(_ *Bot) {
+	if !m.fallingBack {
+		m.fellBack = false
+	}
+}
+
+// OnError 实现了 BotLoginOption 接口
+// 只处理网页版模式下的 loginEnvAbnormality 和 ErrForbidden, 并且只会切换一次
+func (m *ModeFallbackOption) OnError(bot *Bot, err error) error {
+	if m.fellBack || bot.Caller.Client.mode != normal || !shouldFallbackMode(err) {
+		return err
+	}
+	m.fellBack = true
+	if m.OnFallback != nil {
+		m.OnFallback(err)
+	}
+	fallback := m.Fallback
+	if fallback == nil {
+		fallback = desktop
+	}
+	bot.Caller.Client.SetMode(fallback)
+	m.fallingBack = true
+	defer func() { m.fallingBack = false }()
+	return bot.Login()
+}
+
+// OnSuccess 实现了 BotLoginOption 接口, 记录登录成功时使用的模式
+func (m *ModeFallbackOption) OnSuccess(bot *Bot) error {
+	m.mode = bot.Caller.Client.mode
+	m.modeName = bot.Caller.Client.modeName
+	return nil
+}
+
+// FellBack 返回最近一次登录是否切换过模式
+func (m *ModeFallbackOption) FellBack() bool {
+	return m.fellBack
+}
+
+// Mode 返回最后一次登录成功时使用的模式, 没有登录成功时返回 nil
+func (m *ModeFallbackOption) Mode() Mode {
+	return m.mode
+}
+
+// ModeName 返回最后一次登录成功时使用的模式的名称, 如 normal, desktop
+func (m *ModeFallbackOption) ModeName() string {
+	return m.modeName
+}
+
+func shouldFallbackMode(err error) bool {
+	return errors.Is(err, loginEnvAbnormality) || errors.Is(err, ErrForbidden)
+}
+
+// NewModeFallbackOption 创建一个 ModeFallbackOption
+func NewModeFallbackOption() *ModeFallbackOption {
+	return &ModeFallbackOption{}
+}
+
 type BotPreparerFunc func(*Bot)
 
 func (f BotPreparerFunc) Prepare(b *Bot) {
 	f(b)
 }
 
-// withMode 是一个 BotPreparerFunc，用于设置 Bot 的模式
-func withMode(mode Mode) BotPreparer {
+// WithMode 是一个 BotPreparerFunc，用于设置 Bot 的模式, 可以是 NewMode 创建的自定义模式
+func WithMode(mode Mode) BotPreparer {
+	if mode == nil {
+		panic("mode is nil")
+	}
 	return BotPreparerFunc(func(b *Bot) { b.Caller.Client.SetMode(mode) })
 }
 
+// WithModeName 是一个 BotPreparerFunc，用于设置 Bot 的模式为通过 RegisterMode 注册的模式
+// 模式不存在时登录会返回 ErrModeNotRegistered
+func WithModeName(name string) BotPreparer {
+	return BotPreparerFunc(func(b *Bot) {
+		mode, exist := LookupMode(name)
+		if !exist {
+			b.prepareErr = fmt.Errorf("%w: %s", ErrModeNotRegistered, name)
+			return
+		}
+		b.prepareErr = nil
+		b.Caller.Client.setMode(name, mode)
+	})
+}
+
 // btw, 这两个变量已经变了4回了, 但是为了兼容以前的代码, 还是得想着法儿让用户无感知的更新
 var (
 	// Normal 网页版微信模式
-	Normal = withMode(normal)
+	Normal = WithMode(normal)
 
 	// Desktop 桌面微信模式
-	Desktop = withMode(desktop)
+	Desktop = WithMode(desktop)
 )
 
 // WithContextOption 是一个 BotPreparerFunc，用于设置 Bot 的 context
@@ -151,56 +250,134 @@ func WithDeviceID(deviceId string) BotPreparer {
 	return BotPreparerFunc(func(b *Bot) { b.deviceId = deviceId })
 }
 
+// WithQrcodeRefresh 是一个 BotPreparerFunc，用于设置扫码登录时二维码过期后的自动刷新策略
+// maxCount 为最多刷新的次数, deadline 为停止刷新的时间, 两者为零值时表示不做对应的限制, 同时为零值时不刷新
+func WithQrcodeRefresh(maxCount int, deadline time.Time) BotPreparer {
+	return BotPreparerFunc(func(b *Bot) {
+		b.qrcodeRefreshCount = maxCount
+		b.qrcodeRefreshDeadline = deadline
+	})
+}
+
+// WithHotReloadMaxAge 是一个 BotPreparerFunc，用于设置热存储数据的有效期
+// 超过有效期的数据在 HotLogin 和 PushLogin 时会返回 ErrHotReloadExpired
+func WithHotReloadMaxAge(maxAge time.Duration) BotPreparer {
+	return BotPreparerFunc(func(b *Bot) { b.hotReloadMaxAge = maxAge })
+}
+
+// WithSyncDrainLimit 是一个 BotPreparerFunc，用于设置一次同步检查之后最多连续调用 webwxsync 的次数
+// 热登录之后服务端积压了大量消息时会通过 ContinueFlag 要求继续拉取, 达到上限之后等到下一次同步检查再继续
+func WithSyncDrainLimit(limit int) BotPreparer {
+	return BotPreparerFunc(func(b *Bot) { b.syncDrainLimit = limit })
+}
+
 // BotLogin 定义了一个Login的接口
 type BotLogin interface {
 	Login(bot *Bot) error
 }
 
+// contextBotLogin 是可以使用指定的 context 登录的 BotLogin, 登录过程中的请求都使用 ctx
+// LoginWithTimeout 和 LoginChain 通过它把超时传递给内置的登录方式, 而不需要修改 Bot
+type contextBotLogin interface {
+	BotLogin
+	loginContext(ctx context.Context, bot *Bot) error
+}
+
+type botLoginFunc func(ctx context.Context, bot *Bot) error
+
+func (f botLoginFunc) Login(bot *Bot) error {
+	return f(bot.Context(), bot)
+}
+
+func (f botLoginFunc) loginContext(ctx context.Context, bot *Bot) error {
+	return f(ctx, bot)
+}
+
 // ScanLogin 扫码登录
 type ScanLogin struct {
 	UUID string
+
+	// MaxRefreshCount 二维码过期后最多自动刷新的次数
+	MaxRefreshCount int
+
+	// Deadline 超过该时间后二维码过期不再自动刷新
+	Deadline time.Time
 }
 
 // Login 实现了 BotLogin 接口
+// 二维码过期后, 如果允许刷新, 会重新获取 uuid 并再次触发 UUIDCallback
 func (s *ScanLogin) Login(bot *Bot) error {
+	return s.loginContext(bot.Context(), bot)
+}
+
+func (s *ScanLogin) loginContext(ctx context.Context, bot *Bot) error {
 	var uuid = s.UUID
-	if uuid == "" {
-		var err error
-		uuid, err = bot.Caller.GetLoginUUID(bot.Context())
-		if err != nil {
+	for refreshed := 0; ; refreshed++ {
+		if uuid == "" {
+			var err error
+			uuid, err = bot.Caller.GetLoginUUID(ctx)
+			if err != nil {
+				return err
+			}
+		}
+		err := s.checkLogin(ctx, bot, uuid)
+		if !errors.Is(err, ErrLoginTimeout) {
+			return err
+		}
+		// 通知二维码已过期
+		bot.publish(&Event{Type: EventUUIDExpired, UUID: uuid})
+		if !s.canRefresh(refreshed) {
 			return err
 		}
+		uuid = ""
 	}
-	return s.checkLogin(bot, uuid)
+}
+
+// canRefresh 判断已经刷新了 refreshed 次之后是否还能继续刷新二维码
+func (s *ScanLogin) canRefresh(refreshed int) bool {
+	if s.MaxRefreshCount <= 0 && s.Deadline.IsZero() {
+		return false
+	}
+	if s.MaxRefreshCount > 0 && refreshed >= s.MaxRefreshCount {
+		return false
+	}
+	return s.Deadline.IsZero() || time.Now().Before(s.Deadline)
 }
 
 // checkLogin 该方法会一直阻塞，直到用户扫码登录，或者二维码过期
-func (s *ScanLogin) checkLogin(bot *Bot, uuid string) error {
+func (s *ScanLogin) checkLogin(ctx context.Context, bot *Bot, uuid string) error {
 	bot.uuid = uuid
 	loginChecker := &LoginChecker{
 		Bot:           bot,
 		Tip:           "0",
-		UUIDCallback:  bot.UUIDCallback,
-		LoginCallBack: bot.LoginCallBack,
-		ScanCallBack:  bot.ScanCallBack,
+		UUIDCallback:  func(uuid string) { bot.publish(&Event{Type: EventUUID, UUID: uuid}) },
+		LoginCallBack: func(body CheckLoginResponse) { bot.publish(&Event{Type: EventConfirm, LoginResponse: body}) },
+		ScanCallBack:  func(body CheckLoginResponse) { bot.publish(&Event{Type: EventScan, LoginResponse: body}) },
 	}
-	return loginChecker.CheckLogin()
+	return loginChecker.check(ctx)
 }
 
 func botReload(bot *Bot, storage HotReloadStorage) error {
 	if storage == nil {
 		return errors.New("storage is nil")
 	}
+	// 其他进程正在使用这份数据时不能登录, 否则两个进程会互相覆盖 SyncKey
+	if err := bot.holdSessionLease(storage); err != nil {
+		return err
+	}
 	bot.hotReloadStorage = storage
-	var item HotReloadStorageItem
-	if err := json.NewDecoder(storage).Decode(&item); err != nil {
+	envelope, item, err := loadHotReloadItem(storage, bot.hotReloadMaxAge)
+	if err != nil {
 		return err
 	}
 	bot.Caller.Client.SetCookieJar(item.Jar)
 	bot.Storage.LoginInfo = item.LoginInfo
 	bot.Storage.Request = item.BaseRequest
-	bot.Caller.Client.Domain = item.WechatDomain
+	bot.Caller.Client.SetDomain(item.WechatDomain)
 	bot.uuid = item.UUID
+	if bot.deviceId == "" {
+		bot.deviceId = envelope.DeviceID
+	}
 	if item.SyncKey != nil {
 		if bot.Storage.Response == nil {
 			bot.Storage.Response = &WebInitResponse{}
@@ -210,17 +387,48 @@ func botReload(bot *Bot, storage HotReloadStorage) error {
 	return nil
 }
 
+// loadHotReloadItem 从头读取 storage 中的热存储数据, 缺少会话信息时返回 ErrInvalidStorage
+func loadHotReloadItem(storage HotReloadStorage, maxAge time.Duration) (*HotReloadEnvelope, *HotReloadStorageItem, error) {
+	// 同一个 storage 可能会被多种登录方式读取, 如 ChainLogin
+	if seeker, ok := storage.(io.Seeker); ok {
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return nil, nil, err
+		}
+	}
+	envelope, item, err := decodeHotReloadEnvelope(storage, maxAge)
+	if err != nil {
+		if errors.Is(err, ErrInvalidStorage) {
+			return nil, nil, err
+		}
+		return nil, nil, errors.Join(ErrInvalidStorage, err)
+	}
+	// 缺少会话信息的数据无法用于登录
+	if item.Jar == nil || item.LoginInfo == nil || item.BaseRequest == nil || item.BaseRequest.Sid == "" {
+		return nil, nil, ErrInvalidStorage
+	}
+	return envelope, item, nil
+}
+
 // HotLogin 热登录模式
 type HotLogin struct {
 	storage HotReloadStorage
 }
 
+// NewHotLogin 创建一个热登录的 BotLogin
+func NewHotLogin(storage HotReloadStorage) *HotLogin {
+	return &HotLogin{storage: storage}
+}
+
 // Login 实现了 BotLogin 接口
 func (h *HotLogin) Login(bot *Bot) error {
+	return h.loginContext(bot.Context(), bot)
+}
+
+func (h *HotLogin) loginContext(ctx context.Context, bot *Bot) error {
 	if err := botReload(bot, h.storage); err != nil {
 		return err
 	}
-	return bot.webInit()
+	return bot.webInit(ctx)
 }
 
 // PushLogin 免扫码登录模式
@@ -228,32 +436,46 @@ type PushLogin struct {
 	storage HotReloadStorage
 }
 
+// NewPushLogin 创建一个免扫码登录的 BotLogin
+func NewPushLogin(storage HotReloadStorage) *PushLogin {
+	return &PushLogin{storage: storage}
+}
+
 // Login 实现了 BotLogin 接口
 func (p *PushLogin) Login(bot *Bot) error {
+	return p.loginContext(bot.Context(), bot)
+}
+
+func (p *PushLogin) loginContext(ctx context.Context, bot *Bot) error {
 	if err := botReload(bot, p.storage); err != nil {
 		return err
 	}
-	resp, err := bot.Caller.WebWxPushLogin(bot.Context(), bot.Storage.LoginInfo.WxUin)
+	return p.push(ctx, bot)
+}
+
+// push 使用当前的登录信息向手机发送确认登录的请求
+func (p *PushLogin) push(ctx context.Context, bot *Bot) error {
+	resp, err := bot.Caller.WebWxPushLogin(ctx, bot.Storage.LoginInfo.WxUin)
 	if err != nil {
 		return err
 	}
 	if err = resp.Err(); err != nil {
 		return err
 	}
-	return p.checkLogin(bot, resp.UUID)
+	return p.checkLogin(ctx, bot, resp.UUID)
 }
 
 // checkLogin 登录检查
-func (p *PushLogin) checkLogin(bot *Bot, uuid string) error {
+func (p *PushLogin) checkLogin(ctx context.Context, bot *Bot, uuid string) error {
 	bot.uuid = uuid
 	// 为什么把 UUIDCallback 和 ScanCallBack 置为nil呢?
 	// 因为这两个对用户是无感知的。
 	loginChecker := &LoginChecker{
 		Bot:           bot,
 		Tip:           "1",
-		LoginCallBack: bot.LoginCallBack,
+		LoginCallBack: func(body CheckLoginResponse) { bot.publish(&Event{Type: EventConfirm, LoginResponse: body}) },
 	}
-	return loginChecker.CheckLogin()
+	return loginChecker.check(ctx)
 }
 
 type LoginChecker struct {
@@ -265,6 +487,11 @@ type LoginChecker struct {
 }
 
 func (l *LoginChecker) CheckLogin() error {
+	return l.check(l.Bot.Context())
+}
+
+// check 登录过程中的请求都使用 ctx
+func (l *LoginChecker) check(ctx context.Context) error {
 	uuid := l.Bot.UUID()
 	// 二维码获取回调
 	if cb := l.UUIDCallback; cb != nil {
@@ -273,7 +500,7 @@ func (l *LoginChecker) CheckLogin() error {
 	var tip = l.Tip
 	for {
 		// 长轮询检查是否扫码登录
-		resp, err := l.Bot.Caller.CheckLogin(l.Bot.Context(), uuid, tip)
+		resp, err := l.Bot.Caller.CheckLogin(ctx, uuid, tip)
 		if err != nil {
 			return err
 		}
@@ -291,7 +518,7 @@ func (l *LoginChecker) CheckLogin() error {
 			if err != nil {
 				return err
 			}
-			if err = l.Bot.loginFromURL(redirectURL); err != nil {
+			if err = l.Bot.loginFromURL(ctx, redirectURL); err != nil {
 				return err
 			}
 			if cb := l.LoginCallBack; cb != nil {
@@ -311,6 +538,115 @@ func (l *LoginChecker) CheckLogin() error {
 	}
 }
 
+// LoginAttempt 记录了 LoginChain 中一次登录尝试的结果
+type LoginAttempt struct {
+	Login   BotLogin
+	Err     error
+	Skipped bool // 登录方式不适用, 如热存储为空或者数据不完整
+}
+
+// LoginChain 依次尝试多种登录方式, 直到有一个成功
+//
+//	chain := openwechat.ChainLogin(
+//		openwechat.LoginWithTimeout(openwechat.NewPushLogin(storage), time.Minute),
+//		openwechat.NewHotLogin(storage),
+//		&openwechat.ScanLogin{},
+//	)
+//	err := bot.LoginWith(chain)
+type LoginChain struct {
+	// Timeout 每次尝试的超时时间, 为零时不限制, 可以通过 LoginWithTimeout 单独设置
+	Timeout  time.Duration
+	logins   []BotLogin
+	attempts []LoginAttempt
+	winner   BotLogin
+}
+
+// ChainLogin 将多种登录方式组合成一个 BotLogin
+func ChainLogin(logins ...BotLogin) *LoginChain {
+	return &LoginChain{logins: logins}
+}
+
+// Login 实现了 BotLogin 接口
+// 所有的登录方式都失败时, 返回所有尝试的错误
+func (c *LoginChain) Login(bot *Bot) error {
+	return c.loginContext(bot.Context(), bot)
+}
+
+func (c *LoginChain) loginContext(ctx context.Context, bot *Bot) error {
+	c.attempts, c.winner = nil, nil
+	var errs []error
+	for _, login := range c.logins {
+		// bot 已经退出或者超时, 没有必要继续尝试
+		if err := ctx.Err(); err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+		timeout := c.Timeout
+		if t, ok := login.(*timeoutLogin); ok {
+			login, timeout = t.login, t.timeout
+		}
+		err := loginWithContext(ctx, bot, login, timeout)
+		c.attempts = append(c.attempts, LoginAttempt{Login: login, Err: err, Skipped: errors.Is(err, ErrInvalidStorage)})
+		if err == nil {
+			c.winner = login
+			return nil
+		}
+		// 会话被其他进程持有时不再尝试其他登录方式, 扫码登录会把对方挤下线
+		if errors.Is(err, ErrSessionLocked) {
+			return errors.Join(append(errs, err)...)
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return errors.New("no login strategy in chain")
+	}
+	return errors.Join(errs...)
+}
+
+// Winner 返回最后一次登录成功的登录方式, 没有成功时返回 nil
+func (c *LoginChain) Winner() BotLogin {
+	return c.winner
+}
+
+// Attempts 返回最后一次登录过程中每种登录方式的尝试结果
+func (c *LoginChain) Attempts() []LoginAttempt {
+	return c.attempts
+}
+
+// timeoutLogin 为登录过程设置超时时间
+type timeoutLogin struct {
+	login   BotLogin
+	timeout time.Duration
+}
+
+// Login 实现了 BotLogin 接口
+func (t *timeoutLogin) Login(bot *Bot) error {
+	return t.loginContext(bot.Context(), bot)
+}
+
+func (t *timeoutLogin) loginContext(ctx context.Context, bot *Bot) error {
+	return loginWithContext(ctx, bot, t.login, t.timeout)
+}
+
+// LoginWithTimeout 为 login 设置超时时间, 超时后登录返回 context.DeadlineExceeded
+// 超时只作用于登录过程, 不会影响登录成功后的消息同步
+func LoginWithTimeout(login BotLogin, timeout time.Duration) BotLogin {
+	return &timeoutLogin{login: login, timeout: timeout}
+}
+
+// loginWithContext 使用 ctx 登录, timeout 大于零时为 ctx 设置超时时间
+// 自定义的 BotLogin 无法接收 ctx, 只能使用 Bot 的 context
+func loginWithContext(ctx context.Context, bot *Bot, login BotLogin, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if l, ok := login.(contextBotLogin); ok {
+		return l.loginContext(ctx, bot)
+	}
+	return login.Login(bot)
+}
+
 // # 下面都是即将废弃的函数。
 // # 为了兼容老版本暂时留了下来, 但是它的函数签名已经发生了改变。
 // # 如果你是使用的是openwechat提供的api来调用这些函数，那么你是感知不到变动的。
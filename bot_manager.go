@@ -0,0 +1,377 @@
+package openwechat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrAccountRunning 账号已经在运行, 需要先停止或者使用 Restart
+var ErrAccountRunning = errors.New("account is running")
+
+// ErrAccountNotFound 账号不存在
+var ErrAccountNotFound = errors.New("account not found")
+
+// AccountState 定义了 BotManager 中账号的状态
+type AccountState int
+
+const (
+	// AccountLoggingIn 正在登录
+	AccountLoggingIn AccountState = iota + 1
+	// AccountOnline 登录成功, 消息同步正在运行
+	AccountOnline
+	// AccountStopped 通过 Stop 或者 BotManager 的 context 主动停止
+	AccountStopped
+	// AccountCrashed 登录失败或者 bot 因为错误退出
+	AccountCrashed
+)
+
+func (s AccountState) String() string {
+	switch s {
+	case AccountLoggingIn:
+		return "登录中"
+	case AccountOnline:
+		return "在线"
+	case AccountStopped:
+		return "已停止"
+	case AccountCrashed:
+		return "已崩溃"
+	default:
+		return "未知状态"
+	}
+}
+
+// AccountInfo 描述了 BotManager 中一个账号的状态
+type AccountInfo struct {
+	Key       string
+	State     AccountState
+	LoginTime time.Time // 最近一次登录成功的时间
+	Err       error     // 登录失败的错误或者 bot 退出的原因
+}
+
+// ManagerStatus 描述了 BotManager 中所有账号的状态
+type ManagerStatus struct {
+	Total     int
+	LoggingIn int
+	Online    int
+	Stopped   int
+	Crashed   int
+	Accounts  []AccountInfo // 按照 Key 排序
+}
+
+type account struct {
+	key     string
+	bot     *Bot
+	state   AccountState
+	err     error
+	stopped bool             // 是否通过 Stop 主动停止
+	storage HotReloadStorage // 账号退出之后关闭
+}
+
+// BotManager 在一个进程内管理多个账号的 Bot
+// 每个账号对应一个 Bot 和一个 HotReloadStorage, 一个账号退出或者崩溃不会影响其他账号
+// HotReloadStorage 实现了 io.Closer 时, 会在账号的 Bot 退出之后关闭
+//
+//	manager := openwechat.NewBotManager(context.Background())
+//	manager.Storage = func(key string) openwechat.HotReloadStorage {
+//		return openwechat.NewFileHotReloadStorage(key + ".json")
+//	}
+//	manager.MessageHandler = func(msg *openwechat.Message) {}
+//	err := manager.Start("alice", "bob")
+type BotManager struct {
+	// Storage 返回账号对应的热存储, 为空或者返回 nil 时每次都需要扫码登录
+	// 每次启动和重启都会调用, 返回的热存储实现了 io.Closer 时会在账号退出之后关闭
+	Storage func(key string) HotReloadStorage
+
+	// Prepare 返回账号的 Bot 在登录之前使用的 BotPreparer, 如 WithSessionLease 和 WithMode
+	// 也可以通过 BotPreparerFunc 设置 UUIDCallback 等回调
+	Prepare func(key string) []BotPreparer
+
+	// Login 返回账号使用的登录方式, 为空时先尝试热登录, 失败之后扫码登录
+	Login func(key string, storage HotReloadStorage) BotLogin
+
+	// MessageHandler 所有账号共享的消息处理函数, 账号通过 Handle 设置了自己的处理函数时不会调用
+	// 可以通过 msg.Bot() 和 KeyOf 获取消息所属的账号
+	MessageHandler MessageHandler
+
+	// OnExit 账号的 Bot 退出之后的回调, 主动停止时 err 为 nil
+	OnExit func(key string, err error)
+
+	context  context.Context
+	mu       sync.Mutex
+	accounts map[string]*account
+	handlers map[string]MessageHandler
+}
+
+// NewBotManager BotManager 的构造方法
+// 接收外部的 context.Context, 被取消时所有账号都会退出
+func NewBotManager(ctx context.Context) *BotManager {
+	return &BotManager{
+		context:  ctx,
+		accounts: make(map[string]*account),
+		handlers: make(map[string]MessageHandler),
+	}
+}
+
+// Start 并发地创建并登录多个账号, 等待所有账号的登录都结束之后返回
+// 返回所有登录失败的账号的错误, 失败的账号不会影响其他账号
+func (m *BotManager) Start(keys ...string) error {
+	errs := make([]error, len(keys))
+	var wg sync.WaitGroup
+	for i, key := range keys {
+		wg.Add(1)
+		go func(i int, key string) {
+			defer wg.Done()
+			if err := m.start(key, false); err != nil {
+				errs[i] = fmt.Errorf("account %s: %w", key, err)
+			}
+		}(i, key)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Restart 停止账号正在运行的 Bot, 然后重新创建并登录, 账号不存在时会新建
+func (m *BotManager) Restart(key string) error {
+	return m.start(key, true)
+}
+
+func (m *BotManager) start(key string, restart bool) error {
+	m.mu.Lock()
+	acc, exist := m.accounts[key]
+	running := exist && (acc.state == AccountLoggingIn || acc.state == AccountOnline)
+	if running && !restart {
+		m.mu.Unlock()
+		return ErrAccountRunning
+	}
+	if exist {
+		acc.stopped = true
+	}
+	bot := NewBot(m.context)
+	next := &account{key: key, bot: bot, state: AccountLoggingIn}
+	m.accounts[key] = next
+	m.mu.Unlock()
+
+	if running {
+		acc.bot.Exit()
+		m.closeStorage(acc)
+	}
+
+	bot.MessageHandler = m.dispatch(next)
+	if m.Prepare != nil {
+		for _, preparer := range m.Prepare(key) {
+			preparer.Prepare(bot)
+		}
+	}
+	var storage HotReloadStorage
+	if m.Storage != nil {
+		storage = m.Storage(key)
+	}
+	m.mu.Lock()
+	next.storage = storage
+	m.mu.Unlock()
+	err := bot.LoginWith(m.login(key, storage))
+
+	m.mu.Lock()
+	stopped := next.stopped
+	switch {
+	case stopped:
+		// 登录过程中被停止或者重启
+		next.state = AccountStopped
+	case err != nil:
+		next.state, next.err = AccountCrashed, err
+	default:
+		next.state = AccountOnline
+	}
+	m.mu.Unlock()
+
+	if stopped || err != nil {
+		bot.Exit()
+		m.closeStorage(next)
+		if err == nil {
+			err = context.Canceled
+		}
+		return err
+	}
+	go m.watch(next)
+	return nil
+}
+
+func (m *BotManager) login(key string, storage HotReloadStorage) BotLogin {
+	if m.Login != nil {
+		return m.Login(key, storage)
+	}
+	scan := botLoginFunc(func(ctx context.Context, bot *Bot) error { return bot.scanLogin().loginContext(ctx, bot) })
+	if storage == nil {
+		return scan
+	}
+	return ChainLogin(NewHotLogin(storage), scan)
+}
+
+// dispatch 将消息交给账号自己的处理函数或者共享的处理函数
+// 处理函数 panic 时只有当前账号的 Bot 会退出
+func (m *BotManager) dispatch(acc *account) MessageHandler {
+	return func(msg *Message) {
+		defer func() {
+			if r := recover(); r != nil {
+				acc.bot.ExitWith(fmt.Errorf("message handler panic: %v", r))
+			}
+		}()
+		m.mu.Lock()
+		handler := m.handlers[acc.key]
+		m.mu.Unlock()
+		if handler == nil {
+			handler = m.MessageHandler
+		}
+		if handler != nil {
+			handler(msg)
+		}
+	}
+}
+
+// watch 等待账号的 Bot 退出并更新状态
+func (m *BotManager) watch(acc *account) {
+	<-acc.bot.Context().Done()
+	m.closeStorage(acc)
+	m.mu.Lock()
+	var err error
+	if acc.stopped || m.context.Err() != nil {
+		acc.state = AccountStopped
+	} else {
+		err = acc.bot.CrashReason()
+		acc.state, acc.err = AccountCrashed, err
+	}
+	m.mu.Unlock()
+	if m.OnExit != nil {
+		m.OnExit(acc.key, err)
+	}
+}
+
+// closeStorage 关闭账号的热存储, 只会关闭一次
+func (m *BotManager) closeStorage(acc *account) {
+	m.mu.Lock()
+	storage := acc.storage
+	acc.storage = nil
+	m.mu.Unlock()
+	if closer, ok := storage.(io.Closer); ok {
+		_ = closer.Close()
+	}
+}
+
+// Stop 停止账号的 Bot, 账号依然保留在 BotManager 中, 可以通过 Restart 重新登录
+func (m *BotManager) Stop(key string) error {
+	m.mu.Lock()
+	acc, exist := m.accounts[key]
+	if !exist {
+		m.mu.Unlock()
+		return ErrAccountNotFound
+	}
+	running := acc.state == AccountLoggingIn || acc.state == AccountOnline
+	acc.stopped = true
+	m.mu.Unlock()
+	if running {
+		acc.bot.Exit()
+	}
+	return nil
+}
+
+// StopAll 停止所有账号的 Bot
+func (m *BotManager) StopAll() {
+	for _, key := range m.Keys() {
+		_ = m.Stop(key)
+	}
+}
+
+// Remove 停止账号的 Bot 并将账号从 BotManager 中移除
+func (m *BotManager) Remove(key string) error {
+	if err := m.Stop(key); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	delete(m.accounts, key)
+	delete(m.handlers, key)
+	m.mu.Unlock()
+	return nil
+}
+
+// Handle 设置账号自己的消息处理函数, handler 为 nil 时使用共享的 MessageHandler
+// 可以在账号启动之前设置, 重启之后依然有效
+func (m *BotManager) Handle(key string, handler MessageHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if handler == nil {
+		delete(m.handlers, key)
+		return
+	}
+	m.handlers[key] = handler
+}
+
+// Bot 返回账号当前的 Bot
+func (m *BotManager) Bot(key string) (*Bot, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	acc, exist := m.accounts[key]
+	if !exist {
+		return nil, false
+	}
+	return acc.bot, true
+}
+
+// KeyOf 返回 bot 所属的账号, bot 不属于当前的 BotManager 时返回 false
+func (m *BotManager) KeyOf(bot *Bot) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, acc := range m.accounts {
+		if acc.bot == bot {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// Keys 返回所有账号, 按照字典序排序
+func (m *BotManager) Keys() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.accounts))
+	for key := range m.accounts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Status 返回所有账号的状态
+func (m *BotManager) Status() ManagerStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var status ManagerStatus
+	for key, acc := range m.accounts {
+		info := AccountInfo{Key: key, State: acc.state, Err: acc.err}
+		info.LoginTime = unixNanoTime(acc.bot.loginTime.Load())
+		status.Accounts = append(status.Accounts, info)
+		switch acc.state {
+		case AccountLoggingIn:
+			status.LoggingIn++
+		case AccountOnline:
+			status.Online++
+		case AccountStopped:
+			status.Stopped++
+		case AccountCrashed:
+			status.Crashed++
+		}
+	}
+	status.Total = len(status.Accounts)
+	sort.Slice(status.Accounts, func(i, j int) bool { return status.Accounts[i].Key < status.Accounts[j].Key })
+	return status
+}
+
+// Block 阻塞直到 BotManager 的 context 被取消
+func (m *BotManager) Block() error {
+	<-m.context.Done()
+	return m.context.Err()
+}
@@ -0,0 +1,112 @@
+package openwechat
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Reconnector 在消息同步因为可恢复的错误中断之后, 依次尝试免扫码登录和热登录来恢复会话
+// 恢复之后消息同步会继续运行, MessageHandler 和 SyncKey 都保持不变
+type Reconnector struct {
+	// MaxAttempts 最多尝试的次数, 为零时不限制
+	MaxAttempts int
+
+	// Timeout 每次尝试的超时时间, 免扫码登录需要在手机上确认, 为零时不限制
+	Timeout time.Duration
+
+	// OutageTimeout 网络错误持续超过该时间之后尝试重新登录, 为零时网络错误交给 MessageErrorHandler 处理
+	OutageTimeout time.Duration
+
+	// Backoff 返回第 attempt 次尝试之前需要等待的时间, 为空时使用从 1 秒开始的指数退避, 最长 1 分钟
+	Backoff func(attempt int) time.Duration
+
+	// Recoverable 判断导致退出的错误是否可以通过重新登录恢复, 为空时使用 DefaultRecoverable
+	Recoverable func(err error) bool
+
+	// OnAttempt 每次尝试之后的回调, err 为 nil 表示重新登录成功
+	OnAttempt func(attempt int, err error)
+
+	// OnBackoff 每次等待之前的回调
+	OnBackoff func(attempt int, wait time.Duration)
+
+	// OnGiveUp 放弃重连时的回调, 之后 bot 会以 err 退出
+	OnGiveUp func(err error)
+}
+
+// DefaultRecoverable 默认认为 cookie 失效, 系统错误和网络错误可以恢复
+// 用户在手机上主动退出或者在其他地方登录(1100)时不会重新登录, 否则两边会互相挤下线
+func DefaultRecoverable(err error) bool {
+	var ret Ret
+	if errors.As(err, &ret) {
+		return ret == cookieInvalid || ret == sysError
+	}
+	return IsNetworkError(err)
+}
+
+func (r *Reconnector) recoverable(err error) bool {
+	if r.Recoverable != nil {
+		return r.Recoverable(err)
+	}
+	return DefaultRecoverable(err)
+}
+
+// outage 判断是否已经持续了足够长时间的网络错误
+func (r *Reconnector) outage(bot *Bot, err error) bool {
+	if r.OutageTimeout <= 0 || !IsNetworkError(err) {
+		return false
+	}
+	info := bot.SessionInfo()
+	last := info.LastSyncTime
+	if info.LoginTime.After(last) {
+		last = info.LoginTime
+	}
+	return time.Since(last) > r.OutageTimeout
+}
+
+func (r *Reconnector) backoff(attempt int) time.Duration {
+	if r.Backoff != nil {
+		return r.Backoff(attempt)
+	}
+	wait := time.Second << (attempt - 1)
+	if wait > time.Minute || wait <= 0 {
+		wait = time.Minute
+	}
+	return wait
+}
+
+// reconnect 尝试重新登录, 成功时返回 nil, 放弃时返回导致放弃的错误
+func (r *Reconnector) reconnect(bot *Bot, cause error) error {
+	webInit := botLoginFunc(func(ctx context.Context, bot *Bot) error { return bot.webInit(ctx) })
+	chain := ChainLogin(botLoginFunc((&PushLogin{}).push), webInit)
+	chain.Timeout = r.Timeout
+	err := cause
+	for attempt := 1; r.MaxAttempts <= 0 || attempt <= r.MaxAttempts; attempt++ {
+		wait := r.backoff(attempt)
+		if cb := r.OnBackoff; cb != nil {
+			cb(attempt, wait)
+		}
+		select {
+		case <-bot.Context().Done():
+			return errors.Join(cause, bot.Context().Err())
+		case <-time.After(wait):
+		}
+		err = chain.Login(bot)
+		if cb := r.OnAttempt; cb != nil {
+			cb(attempt, err)
+		}
+		if err == nil {
+			return nil
+		}
+	}
+	err = errors.Join(cause, err)
+	if cb := r.OnGiveUp; cb != nil {
+		cb(err)
+	}
+	return err
+}
+
+// WithReconnector 是一个 BotPreparerFunc，用于开启消息同步中断之后的自动重连
+func WithReconnector(reconnector *Reconnector) BotPreparer {
+	return BotPreparerFunc(func(b *Bot) { b.reconnector = reconnector })
+}
@@ -9,6 +9,7 @@ import (
 	"encoding/xml"
 	"errors"
 	"io"
+	"net/http"
 	"net/url"
 	"os"
 )
@@ -92,10 +93,10 @@ func (c *Caller) GetLoginInfo(ctx context.Context, path *url.URL) (*LoginInfo, e
 		return nil, err
 	}
 	if err = loginInfo.Err(); err != nil {
-		return nil, err
+		return nil, withResponse(resp, err)
 	}
 	// set domain
-	c.Client.Domain = WechatDomain(path.Host)
+	c.Client.SetDomain(WechatDomain(path.Host))
 	return &loginInfo, nil
 }
 
@@ -111,7 +112,7 @@ func (c *Caller) WebInit(ctx context.Context, request *BaseRequest) (*WebInitRes
 		return nil, err
 	}
 	if err = webInitResponse.BaseResponse.Err(); err != nil {
-		return nil, err
+		return nil, withResponse(resp, err)
 	}
 	return &webInitResponse, nil
 }
@@ -136,8 +137,7 @@ func (c *Caller) WebWxStatusNotify(ctx context.Context, opt *CallerWebWxStatusNo
 		return err
 	}
 	defer func() { _ = resp.Body.Close() }()
-	parser := MessageResponseParser{resp.Body}
-	return parser.Err()
+	return parseResponseError(resp)
 }
 
 type CallerSyncCheckOptions CallerCommonOptions
@@ -161,6 +161,26 @@ func (c *Caller) SyncCheck(ctx context.Context, opt *CallerSyncCheckOptions) (*S
 	return NewSyncCheckResponse(buffer.Bytes())
 }
 
+// ProbeDomain 使用指定的域名进行一次同步检查, 用于判断当前会话在该域名下是否可用
+// 不会修改 Client 的 Domain
+func (c *Caller) ProbeDomain(ctx context.Context, domain WechatDomain, opt *CallerSyncCheckOptions) (*SyncCheckResponse, error) {
+	syncCheckOption := &ClientSyncCheckOptions{
+		BaseRequest:     opt.BaseRequest,
+		WebInitResponse: opt.WebInitResponse,
+		LoginInfo:       opt.LoginInfo,
+	}
+	resp, err := c.Client.syncCheck(ctx, domain, syncCheckOption)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	var buffer bytes.Buffer
+	if _, err = buffer.ReadFrom(resp.Body); err != nil {
+		return nil, err
+	}
+	return NewSyncCheckResponse(buffer.Bytes())
+}
+
 // WebWxGetContact 获取所有的联系人
 func (c *Caller) WebWxGetContact(ctx context.Context, info *LoginInfo) (Members, error) {
 	var members Members
@@ -179,7 +199,7 @@ func (c *Caller) WebWxGetContact(ctx context.Context, info *LoginInfo) (Members,
 			return nil, err
 		}
 		if err = item.BaseResponse.Err(); err != nil {
-			return nil, err
+			return nil, withResponse(resp, err)
 		}
 		members = append(members, item.MemberList...)
 
@@ -204,7 +224,7 @@ func (c *Caller) WebWxBatchGetContact(ctx context.Context, members Members, requ
 		return nil, err
 	}
 	if err = item.BaseResponse.Err(); err != nil {
-		return nil, err
+		return nil, withResponse(resp, err)
 	}
 	return item.ContactList, nil
 }
@@ -227,6 +247,9 @@ func (c *Caller) WebWxSync(ctx context.Context, opt *CallerWebWxSyncOptions) (*W
 	if err = json.NewDecoder(resp.Body).Decode(&webWxSyncResponse); err != nil {
 		return nil, err
 	}
+	if err = webWxSyncResponse.BaseResponse.Err(); err != nil {
+		return nil, withResponse(resp, err)
+	}
 	return &webWxSyncResponse, nil
 }
 
@@ -248,8 +271,7 @@ func (c *Caller) WebWxSendMsg(ctx context.Context, opt *CallerWebWxSendMsgOption
 		return nil, err
 	}
 	defer func() { _ = resp.Body.Close() }()
-	parser := MessageResponseParser{resp.Body}
-	return parser.SentMessage(opt.Message)
+	return parseSentMessage(resp, opt.Message)
 }
 
 // WebWxSendEmoticon 发送表情接口
@@ -292,8 +314,7 @@ func (c *Caller) WebWxSendEmoticon(ctx context.Context, md5 string, reader io.Re
 		return nil, err
 	}
 	defer func() { _ = resp.Body.Close() }()
-	parser := MessageResponseParser{resp.Body}
-	return parser.SentMessage(msg)
+	return parseSentMessage(resp, msg)
 }
 
 type CallerWebWxOplogOptions struct {
@@ -314,8 +335,7 @@ func (c *Caller) WebWxOplog(ctx context.Context, opt *CallerWebWxOplogOptions) e
 		return err
 	}
 	defer func() { _ = resp.Body.Close() }()
-	parser := MessageResponseParser{resp.Body}
-	return parser.Err()
+	return parseResponseError(resp)
 }
 
 type CallerUploadMediaOptions struct {
@@ -370,7 +390,7 @@ func (c *Caller) UploadMedia(ctx context.Context, file *os.File, opt *CallerUplo
 			return nil, err
 		}
 		if err = checkUploadResponse.BaseResponse.Err(); err != nil {
-			return nil, err
+			return nil, withResponse(resp, err)
 		}
 		// 如果已经上传过了，直接返回
 		if checkUploadResponse.MediaId != "" {
@@ -395,10 +415,10 @@ func (c *Caller) UploadMedia(ctx context.Context, file *os.File, opt *CallerUplo
 		return &item, err
 	}
 	if err = item.BaseResponse.Err(); err != nil {
-		return &item, err
+		return &item, withResponse(resp, err)
 	}
 	if len(item.MediaId) == 0 {
-		return &item, errors.New("upload failed")
+		return &item, withResponse(resp, &APIError{ErrMsg: "upload failed: empty media id"})
 	}
 	item.Signature = clientWebWxUploadMediaByChunkOpt.Signature
 	return &item, nil
@@ -448,8 +468,7 @@ func (c *Caller) WebWxSendImageMsg(ctx context.Context, reader io.Reader, opt *C
 		return nil, err
 	}
 	defer func() { _ = resp.Body.Close() }()
-	parser := MessageResponseParser{resp.Body}
-	return parser.SentMessage(msg)
+	return parseSentMessage(resp, msg)
 }
 
 type CallerWebWxSendFileOptions CallerUploadMediaCommonOptions
@@ -515,8 +534,7 @@ func (c *Caller) WebWxSendVideoMsg(ctx context.Context, reader io.Reader, opt *C
 		return nil, err
 	}
 	defer func() { _ = resp.Body.Close() }()
-	parser := MessageResponseParser{resp.Body}
-	return parser.SentMessage(msg)
+	return parseSentMessage(resp, msg)
 }
 
 // WebWxSendAppMsg 发送媒体消息
@@ -526,8 +544,7 @@ func (c *Caller) WebWxSendAppMsg(ctx context.Context, msg *SendMessage, req *Bas
 		return nil, err
 	}
 	defer func() { _ = resp.Body.Close() }()
-	parser := MessageResponseParser{resp.Body}
-	return parser.SentMessage(msg)
+	return parseSentMessage(resp, msg)
 }
 
 // Logout 用户退出
@@ -537,8 +554,7 @@ func (c *Caller) Logout(ctx context.Context, info *LoginInfo) error {
 		return err
 	}
 	defer func() { _ = resp.Body.Close() }()
-	parser := MessageResponseParser{resp.Body}
-	return parser.Err()
+	return parseResponseError(resp)
 }
 
 type CallerAddFriendIntoChatRoomOptions struct {
@@ -570,8 +586,7 @@ func (c *Caller) AddFriendIntoChatRoom(ctx context.Context, opt *CallerAddFriend
 		return err
 	}
 	defer func() { _ = resp.Body.Close() }()
-	parser := MessageResponseParser{resp.Body}
-	return parser.Err()
+	return parseResponseError(resp)
 }
 
 type CallerRemoveFriendFromChatRoomOptions struct {
@@ -601,8 +616,7 @@ func (c *Caller) RemoveFriendFromChatRoom(ctx context.Context, opt *CallerRemove
 		return err
 	}
 	defer func() { _ = resp.Body.Close() }()
-	parser := MessageResponseParser{resp.Body}
-	return parser.Err()
+	return parseResponseError(resp)
 }
 
 type CallerWebWxVerifyUserOptions struct {
@@ -625,8 +639,7 @@ func (c *Caller) WebWxVerifyUser(ctx context.Context, opt *CallerWebWxVerifyUser
 		return err
 	}
 	defer func() { _ = resp.Body.Close() }()
-	parser := MessageResponseParser{resp.Body}
-	return parser.Err()
+	return parseResponseError(resp)
 }
 
 // WebWxRevokeMsg 撤回消息操作
@@ -636,8 +649,7 @@ func (c *Caller) WebWxRevokeMsg(ctx context.Context, msg *SentMessage, request *
 		return err
 	}
 	defer func() { _ = resp.Body.Close() }()
-	parser := MessageResponseParser{resp.Body}
-	return parser.Err()
+	return parseResponseError(resp)
 }
 
 type CallerWebWxStatusAsReadOptions struct {
@@ -658,8 +670,7 @@ func (c *Caller) WebWxStatusAsRead(ctx context.Context, opt *CallerWebWxStatusAs
 		return err
 	}
 	defer func() { _ = resp.Body.Close() }()
-	parser := MessageResponseParser{resp.Body}
-	return parser.Err()
+	return parseResponseError(resp)
 }
 
 type CallerWebWxRelationPinOptions struct {
@@ -681,8 +692,7 @@ func (c *Caller) WebWxRelationPin(ctx context.Context, opt *CallerWebWxRelationP
 		return err
 	}
 	defer func() { _ = resp.Body.Close() }()
-	parser := MessageResponseParser{resp.Body}
-	return parser.Err()
+	return parseResponseError(resp)
 }
 
 // WebWxPushLogin 免扫码登陆接口
@@ -734,7 +744,7 @@ func (c *Caller) WebWxCreateChatRoom(ctx context.Context, opt *CallerWebWxCreate
 		return nil, err
 	}
 	if err = item.BaseResponse.Err(); err != nil {
-		return nil, err
+		return nil, withResponse(resp, err)
 	}
 	group := Group{User: &User{UserName: item.ChatRoomName}}
 	return &group, nil
@@ -760,13 +770,36 @@ func (c *Caller) WebWxRenameChatRoom(ctx context.Context, opt *CallerWebWxRename
 		return err
 	}
 	defer func() { _ = resp.Body.Close() }()
-	parser := MessageResponseParser{resp.Body}
-	return parser.Err()
+	return parseResponseError(resp)
 }
 
 // SetMode 设置Client的模式
 func (c *Client) SetMode(mode Mode) {
+	c.setMode(modeName(mode), mode)
+}
+
+// setMode 设置Client的模式, 并记录模式的名称
+func (c *Client) setMode(name string, mode Mode) {
 	c.mode = mode
+	c.modeName = name
+}
+
+// Mode 返回Client当前的模式
+func (c *Client) Mode() Mode {
+	return c.mode
+}
+
+// parseResponseError 解析只携带了 BaseResponse 的响应
+func parseResponseError(resp *http.Response) error {
+	parser := MessageResponseParser{resp.Body}
+	return withResponse(resp, parser.Err())
+}
+
+// parseSentMessage 解析发送消息的响应
+func parseSentMessage(resp *http.Response, msg *SendMessage) (*SentMessage, error) {
+	parser := MessageResponseParser{resp.Body}
+	sent, err := parser.SentMessage(msg)
+	return sent, withResponse(resp, err)
 }
 
 // MessageResponseParser 消息响应解析器
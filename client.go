@@ -14,6 +14,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -69,20 +70,25 @@ type Client struct {
 	// see normalMode desktopMode
 	mode Mode
 
+	// modeName 设置模式时记录的模式名称, 写入热存储数据
+	modeName string
+
 	// client http客户端
 	client *http.Client
 
-	// Domain 微信服务器请求域名
-	// 这个参数会在登录成功后被赋值
-	// 之后所有的请求都会使用这个域名
-	// 在登录热登录和扫码登录时会被重新赋值
-	Domain WechatDomain
+	// domain 微信服务器请求域名, 通过 Domain 和 SetDomain 读写
+	// 消息同步切换域名时其他 goroutine 可能正在发送请求, 所以需要加锁
+	domain   WechatDomain
+	domainMu sync.RWMutex
 
 	// HttpHooks 请求上下文钩子
 	HttpHooks HttpHooks
 
-	// MaxRetryTimes 最大重试次数
+	// MaxRetryTimes 最大重试次数, 没有设置 RetryPolicy 时生效, 只在网络错误和 5xx 时立即重试
 	MaxRetryTimes int
+
+	// RetryPolicy 请求失败时的重试策略, 可以重试网络错误、5xx 和 BaseResponse 中的错误码, 如 BackoffRetryPolicy
+	RetryPolicy RetryPolicy
 }
 
 // NewClient 创建一个新的客户端
@@ -114,24 +120,29 @@ func DefaultClient() *Client {
 	return client
 }
 
+// Domain 返回微信服务器请求域名
+// 这个域名会在登录成功后被赋值, 之后所有的请求都会使用这个域名
+func (c *Client) Domain() WechatDomain {
+	c.domainMu.RLock()
+	defer c.domainMu.RUnlock()
+	return c.domain
+}
+
+// SetDomain 设置微信服务器请求域名
+// 在热登录、扫码登录和切换域名时会被重新赋值, 可以和正在发送的请求同时调用
+func (c *Client) SetDomain(domain WechatDomain) {
+	c.domainMu.Lock()
+	defer c.domainMu.Unlock()
+	c.domain = domain
+}
+
 // AddHttpHook 添加一个请求上下文钩子
 func (c *Client) AddHttpHook(hooks ...HttpHook) {
 	c.HttpHooks = append(c.HttpHooks, hooks...)
 }
 
 func (c *Client) do(req *http.Request) (*http.Response, error) {
-	// 确保请求能够被执行
-	if c.MaxRetryTimes <= 0 {
-		c.MaxRetryTimes = 1
-	}
-	var (
-		resp        *http.Response
-		err         error
-		requestBody *bytes.Reader
-	)
-
-	c.HttpHooks.BeforeRequest(req)
-	defer func() { c.HttpHooks.AfterRequest(resp, err) }()
+	var requestBody *bytes.Reader
 	if req.Body != nil {
 		rawBody, err := io.ReadAll(req.Body)
 		if err != nil {
@@ -139,23 +150,68 @@ func (c *Client) do(req *http.Request) (*http.Response, error) {
 		}
 		requestBody = bytes.NewReader(rawBody)
 	}
-	for i := 0; i < c.MaxRetryTimes; i++ {
+	policy := c.retryPolicy()
+	for attempt := 1; ; attempt++ {
 		if requestBody != nil {
-			_, err := requestBody.Seek(0, io.SeekStart)
-			if err != nil {
+			if _, err := requestBody.Seek(0, io.SeekStart); err != nil {
 				return nil, fmt.Errorf("requestBody.Seek: %w", err)
 			}
 			req.Body = io.NopCloser(requestBody)
 		}
-		resp, err = c.client.Do(req)
+		resp, err := c.attempt(req)
 		if err == nil {
-			break
+			return resp, nil
+		}
+		wait, retry := policy.Backoff(req, attempt, err)
+		if !retry {
+			// 接口返回的错误码交给 Caller 解析
+			if resp != nil {
+				return resp, nil
+			}
+			return nil, err
+		}
+		if resp != nil {
+			_ = resp.Body.Close()
 		}
+		if ctxErr := sleepContext(req.Context(), wait); ctxErr != nil {
+			return nil, errors.Join(err, ctxErr)
+		}
+	}
+}
+
+// attempt 执行一次请求, 每次请求都会经过 HttpHooks
+// 接口返回了错误码时 resp 不为空, err 为 *APIError, 只有设置了 RetryPolicy 时才会检查错误码
+func (c *Client) attempt(req *http.Request) (resp *http.Response, err error) {
+	c.HttpHooks.BeforeRequest(req)
+	if decorator, ok := c.mode.(ModeRequestDecorator); ok {
+		decorator.DecorateRequest(req)
 	}
+	defer func() { c.HttpHooks.AfterRequest(resp, err) }()
+	resp, err = c.client.Do(req)
 	if err != nil {
-		err = errors.Join(NetworkErr, err)
+		return nil, errors.Join(NetworkErr, err)
 	}
-	return resp, err
+	if resp.StatusCode >= http.StatusBadRequest {
+		_ = resp.Body.Close()
+		return nil, newStatusError(resp)
+	}
+	if c.RetryPolicy != nil {
+		if apiError := peekAPIError(resp); apiError != nil {
+			return resp, apiError
+		}
+	}
+	return resp, nil
+}
+
+// retryPolicy 没有设置 RetryPolicy 时只在网络错误时立即重试, 最多请求 MaxRetryTimes 次
+func (c *Client) retryPolicy() RetryPolicy {
+	if c.RetryPolicy != nil {
+		return c.RetryPolicy
+	}
+	if c.MaxRetryTimes <= 0 {
+		return maxRetryTimesPolicy(1)
+	}
+	return maxRetryTimesPolicy(c.MaxRetryTimes)
 }
 
 func (c *Client) Do(req *http.Request) (*http.Response, error) {
@@ -232,7 +288,7 @@ func (c *Client) GetLoginInfo(ctx context.Context, path *url.URL) (*http.Respons
 
 // WebInit 请求获取初始化信息
 func (c *Client) WebInit(ctx context.Context, request *BaseRequest) (*http.Response, error) {
-	path, err := url.Parse(c.Domain.BaseHost() + webwxinit)
+	path, err := url.Parse(c.Domain().BaseHost() + webwxinit)
 	if err != nil {
 		return nil, err
 	}
@@ -262,7 +318,7 @@ type ClientWebWxStatusNotifyOptions ClientCommonOptions
 
 // WebWxStatusNotify 通知手机已登录
 func (c *Client) WebWxStatusNotify(ctx context.Context, opt *ClientWebWxStatusNotifyOptions) (*http.Response, error) {
-	path, err := url.Parse(c.Domain.BaseHost() + webwxstatusnotify)
+	path, err := url.Parse(c.Domain().BaseHost() + webwxstatusnotify)
 	if err != nil {
 		return nil, err
 	}
@@ -294,7 +350,12 @@ type ClientSyncCheckOptions ClientCommonOptions
 
 // SyncCheck 异步检查是否有新的消息返回
 func (c *Client) SyncCheck(ctx context.Context, opt *ClientSyncCheckOptions) (*http.Response, error) {
-	path, err := url.Parse(c.Domain.SyncHost() + synccheck)
+	return c.syncCheck(ctx, c.Domain(), opt)
+}
+
+// syncCheck 向指定域名的消息同步服务发起同步检查
+func (c *Client) syncCheck(ctx context.Context, domain WechatDomain, opt *ClientSyncCheckOptions) (*http.Response, error) {
+	path, err := url.Parse(domain.SyncHost() + synccheck)
 	if err != nil {
 		return nil, err
 	}
@@ -323,7 +384,7 @@ func (c *Client) SyncCheck(ctx context.Context, opt *ClientSyncCheckOptions) (*h
 
 // WebWxGetContact 获取联系人信息
 func (c *Client) WebWxGetContact(ctx context.Context, sKey string, reqs int64) (*http.Response, error) {
-	path, err := url.Parse(c.Domain.BaseHost() + webwxgetcontact)
+	path, err := url.Parse(c.Domain().BaseHost() + webwxgetcontact)
 	if err != nil {
 		return nil, err
 	}
@@ -341,7 +402,7 @@ func (c *Client) WebWxGetContact(ctx context.Context, sKey string, reqs int64) (
 
 // WebWxBatchGetContact 获取联系人详情
 func (c *Client) WebWxBatchGetContact(ctx context.Context, members Members, request *BaseRequest) (*http.Response, error) {
-	path, err := url.Parse(c.Domain.BaseHost() + webwxbatchgetcontact)
+	path, err := url.Parse(c.Domain().BaseHost() + webwxbatchgetcontact)
 	if err != nil {
 		return nil, err
 	}
@@ -371,7 +432,7 @@ type ClientWebWxSyncOptions ClientCommonOptions
 
 // WebWxSync 获取消息接口
 func (c *Client) WebWxSync(ctx context.Context, opt *ClientWebWxSyncOptions) (*http.Response, error) {
-	path, err := url.Parse(c.Domain.BaseHost() + webwxsync)
+	path, err := url.Parse(c.Domain().BaseHost() + webwxsync)
 	if err != nil {
 		return nil, err
 	}
@@ -425,7 +486,7 @@ type ClientWebWxSendMsgOptions struct {
 // WebWxSendMsg 发送文本消息
 func (c *Client) WebWxSendMsg(ctx context.Context, opt *ClientWebWxSendMsgOptions) (*http.Response, error) {
 	opt.Message.Type = MsgTypeText
-	path, err := url.Parse(c.Domain.BaseHost() + webwxsendmsg)
+	path, err := url.Parse(c.Domain().BaseHost() + webwxsendmsg)
 	if err != nil {
 		return nil, err
 	}
@@ -439,7 +500,7 @@ func (c *Client) WebWxSendMsg(ctx context.Context, opt *ClientWebWxSendMsgOption
 // WebWxSendMsg 发送表情消息
 func (c *Client) WebWxSendEmoticon(ctx context.Context, opt *ClientWebWxSendMsgOptions) (*http.Response, error) {
 	opt.Message.Type = MsgTypeText
-	path, err := url.Parse(c.Domain.BaseHost() + webwxsendemoticon)
+	path, err := url.Parse(c.Domain().BaseHost() + webwxsendemoticon)
 	if err != nil {
 		return nil, err
 	}
@@ -455,7 +516,7 @@ func (c *Client) WebWxSendEmoticon(ctx context.Context, opt *ClientWebWxSendMsgO
 func (c *Client) WebWxGetHeadImg(ctx context.Context, user *User) (*http.Response, error) {
 	var path string
 	if user.HeadImgUrl != "" {
-		path = c.Domain.BaseHost() + user.HeadImgUrl
+		path = c.Domain().BaseHost() + user.HeadImgUrl
 	} else {
 		params := url.Values{}
 		params.Add("username", user.UserName)
@@ -463,7 +524,7 @@ func (c *Client) WebWxGetHeadImg(ctx context.Context, user *User) (*http.Respons
 		params.Add("type", "big")
 		params.Add("chatroomid", user.EncryChatRoomId)
 		params.Add("seq", "0")
-		URL, err := url.Parse(c.Domain.BaseHost() + webwxgeticon)
+		URL, err := url.Parse(c.Domain().BaseHost() + webwxgeticon)
 		if err != nil {
 			return nil, err
 		}
@@ -496,7 +557,7 @@ type webWxCheckUploadResponse struct {
 }
 
 func (c *Client) webWxCheckUploadRequest(ctx context.Context, req webWxCheckUploadRequest) (*http.Response, error) {
-	path, err := url.Parse(c.Domain.BaseHost() + webwxcheckupload)
+	path, err := url.Parse(c.Domain().BaseHost() + webwxcheckupload)
 	if err != nil {
 		return nil, err
 	}
@@ -567,7 +628,7 @@ func (c *Client) WebWxUploadMediaByChunk(ctx context.Context, file UploadFile, o
 	// 获取文件的类型
 	mediaType := messageType(filename)
 
-	path, err := url.Parse(c.Domain.FileHost() + webwxuploadmedia)
+	path, err := url.Parse(c.Domain().FileHost() + webwxuploadmedia)
 	if err != nil {
 		return nil, err
 	}
@@ -673,8 +734,7 @@ func (c *Client) WebWxUploadMediaByChunk(ctx context.Context, file UploadFile, o
 			isLastTime := chunk+1 == chunks
 			if !isLastTime {
 				defer func() { _ = resp.Body.Close() }()
-				parser := MessageResponseParser{Reader: resp.Body}
-				err = parser.Err()
+				err = parseResponseError(resp)
 			}
 		}
 		return err
@@ -698,7 +758,7 @@ func (c *Client) WebWxUploadMediaByChunk(ctx context.Context, file UploadFile, o
 // 发送的图片必须是已经成功上传的图片
 func (c *Client) WebWxSendMsgImg(ctx context.Context, opt *ClientWebWxSendMsgOptions) (*http.Response, error) {
 	opt.Message.Type = MsgTypeImage
-	path, err := url.Parse(c.Domain.BaseHost() + webwxsendmsgimg)
+	path, err := url.Parse(c.Domain().BaseHost() + webwxsendmsgimg)
 	if err != nil {
 		return nil, err
 	}
@@ -714,7 +774,7 @@ func (c *Client) WebWxSendMsgImg(ctx context.Context, opt *ClientWebWxSendMsgOpt
 // WebWxSendAppMsg 发送文件信息
 func (c *Client) WebWxSendAppMsg(ctx context.Context, msg *SendMessage, request *BaseRequest) (*http.Response, error) {
 	msg.Type = AppMessage
-	path, err := url.Parse(c.Domain.BaseHost() + webwxsendappmsg)
+	path, err := url.Parse(c.Domain().BaseHost() + webwxsendappmsg)
 	if err != nil {
 		return nil, err
 	}
@@ -734,7 +794,7 @@ type ClientWebWxOplogOption struct {
 
 // WebWxOplog 用户重命名接口
 func (c *Client) WebWxOplog(ctx context.Context, opt *ClientWebWxOplogOption) (*http.Response, error) {
-	path, err := url.Parse(c.Domain.BaseHost() + webwxoplog)
+	path, err := url.Parse(c.Domain().BaseHost() + webwxoplog)
 	if err != nil {
 		return nil, err
 	}
@@ -769,7 +829,7 @@ type ClientWebWxVerifyUserOption struct {
 // WebWxVerifyUser 添加用户为好友接口
 func (c *Client) WebWxVerifyUser(ctx context.Context, opt *ClientWebWxVerifyUserOption) (*http.Response, error) {
 	loginInfo := opt.LoginInfo
-	path, err := url.Parse(c.Domain.BaseHost() + webwxverifyuser)
+	path, err := url.Parse(c.Domain().BaseHost() + webwxverifyuser)
 	if err != nil {
 		return nil, err
 	}
@@ -805,7 +865,7 @@ func (c *Client) WebWxVerifyUser(ctx context.Context, opt *ClientWebWxVerifyUser
 
 // WebWxGetMsgImg 获取图片消息的图片响应
 func (c *Client) WebWxGetMsgImg(ctx context.Context, msg *Message, info *LoginInfo) (*http.Response, error) {
-	path, err := url.Parse(c.Domain.BaseHost() + webwxgetmsgimg)
+	path, err := url.Parse(c.Domain().BaseHost() + webwxgetmsgimg)
 	if err != nil {
 		return nil, err
 	}
@@ -823,7 +883,7 @@ func (c *Client) WebWxGetMsgImg(ctx context.Context, msg *Message, info *LoginIn
 
 // WebWxGetVoice 获取语音消息的语音响应
 func (c *Client) WebWxGetVoice(ctx context.Context, msg *Message, info *LoginInfo) (*http.Response, error) {
-	path, err := url.Parse(c.Domain.BaseHost() + webwxgetvoice)
+	path, err := url.Parse(c.Domain().BaseHost() + webwxgetvoice)
 	if err != nil {
 		return nil, err
 	}
@@ -842,7 +902,7 @@ func (c *Client) WebWxGetVoice(ctx context.Context, msg *Message, info *LoginInf
 
 // WebWxGetVideo 获取视频消息的视频响应
 func (c *Client) WebWxGetVideo(ctx context.Context, msg *Message, info *LoginInfo) (*http.Response, error) {
-	path, err := url.Parse(c.Domain.BaseHost() + webwxgetvideo)
+	path, err := url.Parse(c.Domain().BaseHost() + webwxgetvideo)
 	if err != nil {
 		return nil, err
 	}
@@ -861,7 +921,7 @@ func (c *Client) WebWxGetVideo(ctx context.Context, msg *Message, info *LoginInf
 
 // WebWxGetMedia 获取文件消息的文件响应
 func (c *Client) WebWxGetMedia(ctx context.Context, msg *Message, info *LoginInfo) (*http.Response, error) {
-	path, err := url.Parse(c.Domain.FileHost() + webwxgetmedia)
+	path, err := url.Parse(c.Domain().FileHost() + webwxgetmedia)
 	if err != nil {
 		return nil, err
 	}
@@ -882,13 +942,13 @@ func (c *Client) WebWxGetMedia(ctx context.Context, msg *Message, info *LoginInf
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Add("Referer", c.Domain.BaseHost()+"/")
+	req.Header.Add("Referer", c.Domain().BaseHost()+"/")
 	return c.Do(req)
 }
 
 // Logout 用户退出
 func (c *Client) Logout(ctx context.Context, info *LoginInfo) (*http.Response, error) {
-	path, err := url.Parse(c.Domain.BaseHost() + webwxlogout)
+	path, err := url.Parse(c.Domain().BaseHost() + webwxlogout)
 	if err != nil {
 		return nil, err
 	}
@@ -922,7 +982,7 @@ func (c *Client) AddMemberIntoChatRoom(ctx context.Context, opt *ClientAddMember
 
 // addMemberIntoChatRoom 添加用户进群聊
 func (c *Client) addMemberIntoChatRoom(ctx context.Context, opt *ClientAddMemberIntoChatRoomOption) (*http.Response, error) {
-	path, err := url.Parse(c.Domain.BaseHost() + webwxupdatechatroom)
+	path, err := url.Parse(c.Domain().BaseHost() + webwxupdatechatroom)
 	if err != nil {
 		return nil, err
 	}
@@ -950,7 +1010,7 @@ func (c *Client) addMemberIntoChatRoom(ctx context.Context, opt *ClientAddMember
 
 // InviteMemberIntoChatRoom 邀请用户进群聊
 func (c *Client) InviteMemberIntoChatRoom(ctx context.Context, opt *ClientAddMemberIntoChatRoomOption) (*http.Response, error) {
-	path, err := url.Parse(c.Domain.BaseHost() + webwxupdatechatroom)
+	path, err := url.Parse(c.Domain().BaseHost() + webwxupdatechatroom)
 	if err != nil {
 		return nil, err
 	}
@@ -985,7 +1045,7 @@ type ClientRemoveMemberFromChatRoomOption struct {
 
 // RemoveMemberFromChatRoom 从群聊中移除用户
 func (c *Client) RemoveMemberFromChatRoom(ctx context.Context, opt *ClientRemoveMemberFromChatRoomOption) (*http.Response, error) {
-	path, err := url.Parse(c.Domain.BaseHost() + webwxupdatechatroom)
+	path, err := url.Parse(c.Domain().BaseHost() + webwxupdatechatroom)
 	if err != nil {
 		return nil, err
 	}
@@ -1022,7 +1082,7 @@ func (c *Client) WebWxRevokeMsg(ctx context.Context, msg *SentMessage, request *
 	if err != nil {
 		return nil, err
 	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Domain.BaseHost()+webwxrevokemsg, buffer)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Domain().BaseHost()+webwxrevokemsg, buffer)
 	if err != nil {
 		return nil, err
 	}
@@ -1033,7 +1093,7 @@ func (c *Client) WebWxRevokeMsg(ctx context.Context, msg *SentMessage, request *
 // 校验上传文件
 // nolint:unused
 func (c *Client) webWxCheckUpload(stat os.FileInfo, request *BaseRequest, fileMd5, fromUserName, toUserName string) (*http.Response, error) {
-	path, err := url.Parse(c.Domain.BaseHost() + webwxcheckupload)
+	path, err := url.Parse(c.Domain().BaseHost() + webwxcheckupload)
 	if err != nil {
 		return nil, err
 	}
@@ -1065,7 +1125,7 @@ type ClientWebWxStatusAsReadOption struct {
 }
 
 func (c *Client) WebWxStatusAsRead(ctx context.Context, opt *ClientWebWxStatusAsReadOption) (*http.Response, error) {
-	path, err := url.Parse(c.Domain.BaseHost() + webwxstatusnotify)
+	path, err := url.Parse(c.Domain().BaseHost() + webwxstatusnotify)
 	if err != nil {
 		return nil, err
 	}
@@ -1101,7 +1161,7 @@ type ClientWebWxRelationPinOption struct {
 
 // WebWxRelationPin 联系人置顶接口
 func (c *Client) WebWxRelationPin(ctx context.Context, opt *ClientWebWxRelationPinOption) (*http.Response, error) {
-	path, err := url.Parse(c.Domain.BaseHost() + webwxoplog)
+	path, err := url.Parse(c.Domain().BaseHost() + webwxoplog)
 	if err != nil {
 		return nil, err
 	}
@@ -1126,7 +1186,7 @@ func (c *Client) WebWxRelationPin(ctx context.Context, opt *ClientWebWxRelationP
 
 // WebWxPushLogin 免扫码登陆接口
 func (c *Client) WebWxPushLogin(ctx context.Context, uin int64) (*http.Response, error) {
-	req, err := c.mode.BuildPushLoginRequest(ctx, c.Domain.BaseHost(), uin)
+	req, err := c.mode.BuildPushLoginRequest(ctx, c.Domain().BaseHost(), uin)
 	if err != nil {
 		return nil, err
 	}
@@ -1135,7 +1195,7 @@ func (c *Client) WebWxPushLogin(ctx context.Context, uin int64) (*http.Response,
 
 // WebWxSendVideoMsg 发送视频消息接口
 func (c *Client) WebWxSendVideoMsg(ctx context.Context, request *BaseRequest, msg *SendMessage) (*http.Response, error) {
-	path, err := url.Parse(c.Domain.BaseHost() + webwxsendvideomsg)
+	path, err := url.Parse(c.Domain().BaseHost() + webwxsendvideomsg)
 	if err != nil {
 		return nil, err
 	}
@@ -1157,7 +1217,7 @@ type ClientWebWxCreateChatRoomOption struct {
 
 // WebWxCreateChatRoom 创建群聊
 func (c *Client) WebWxCreateChatRoom(ctx context.Context, opt *ClientWebWxCreateChatRoomOption) (*http.Response, error) {
-	path, err := url.Parse(c.Domain.BaseHost() + webwxcreatechatroom)
+	path, err := url.Parse(c.Domain().BaseHost() + webwxcreatechatroom)
 	if err != nil {
 		return nil, err
 	}
@@ -1197,7 +1257,7 @@ type ClientWebWxRenameChatRoomOption struct {
 
 // WebWxRenameChatRoom 群组重命名接口
 func (c *Client) WebWxRenameChatRoom(ctx context.Context, opt *ClientWebWxRenameChatRoomOption) (*http.Response, error) {
-	path, err := url.Parse(c.Domain.BaseHost() + webwxupdatechatroom)
+	path, err := url.Parse(c.Domain().BaseHost() + webwxupdatechatroom)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,180 @@
+package openwechat
+
+// ContactEventType 联系人变更事件的类型
+type ContactEventType int
+
+const (
+	// ContactAdded 新增了联系人, 如添加好友或者群组被保存到通讯录
+	ContactAdded ContactEventType = iota + 1
+	// ContactRemoved 删除了联系人
+	ContactRemoved
+	// ContactModified 联系人的昵称、备注或者头像发生了变化, 群组的昵称变化为 GroupRenamed
+	ContactModified
+	// GroupMemberJoined 有成员加入了群组
+	GroupMemberJoined
+	// GroupMemberLeft 有成员离开了群组
+	GroupMemberLeft
+	// GroupRenamed 群组的名称发生了变化
+	GroupRenamed
+)
+
+func (t ContactEventType) String() string {
+	switch t {
+	case ContactAdded:
+		return "ContactAdded"
+	case ContactRemoved:
+		return "ContactRemoved"
+	case ContactModified:
+		return "ContactModified"
+	case GroupMemberJoined:
+		return "GroupMemberJoined"
+	case GroupMemberLeft:
+		return "GroupMemberLeft"
+	case GroupRenamed:
+		return "GroupRenamed"
+	default:
+		return "Unknown"
+	}
+}
+
+// 变更的字段名称
+const (
+	FieldNickName   = "NickName"
+	FieldRemarkName = "RemarkName"
+	FieldHeadImgUrl = "HeadImgUrl"
+)
+
+// FieldChange 记录了一个字段变更前后的值
+type FieldChange struct {
+	Field string
+	Old   string
+	New   string
+}
+
+// ContactEvent 联系人变更事件
+type ContactEvent struct {
+	Type ContactEventType
+	// Contact 发生变更的联系人, 群组事件中为群组, 是联系人缓存中的对象
+	Contact *User
+	// Member 加入或者离开群组的成员, 只在 GroupMemberJoined 和 GroupMemberLeft 中有值
+	Member *User
+	// Changes 变更的字段, 只在 ContactModified 和 GroupRenamed 中有值
+	Changes []FieldChange
+}
+
+// Changed 查找字段的变更
+func (e *ContactEvent) Changed(field string) (FieldChange, bool) {
+	for _, change := range e.Changes {
+		if change.Field == field {
+			return change, true
+		}
+	}
+	return FieldChange{}, false
+}
+
+// ContactEventHandler 处理联系人变更事件的函数
+type ContactEventHandler func(event *ContactEvent)
+
+// OnContactEvent 注册联系人变更事件的处理函数, 不指定类型时处理所有的联系人变更事件
+// 它是订阅 EventContact 的简便写法, 返回的 Subscription 可以用于取消订阅
+// 处理函数在消息同步的 goroutine 中调用, 在同一次同步的消息被处理之前调用
+// 事件通过比较联系人缓存得到, 需要在登录之前注册, 消息同步开始时会加载联系人列表和群成员作为比较的基准
+//
+//	bot.OnContactEvent(func(event *openwechat.ContactEvent) {
+//		fmt.Println(event.Member.NickName, "加入了", event.Contact.NickName)
+//	}, openwechat.GroupMemberJoined)
+func (b *Bot) OnContactEvent(handler ContactEventHandler, types ...ContactEventType) *Subscription {
+	return b.Subscribe(func(event *Event) {
+		if len(types) == 0 {
+			handler(event.Contact)
+			return
+		}
+		for _, t := range types {
+			if t == event.Contact.Type {
+				handler(event.Contact)
+				return
+			}
+		}
+	}, EventContact)
+}
+
+// loadContactsForEvents 订阅了联系人变更事件时加载联系人和群成员, 作为比较变更的基准
+// 订阅所有事件的订阅者不会触发加载
+func (b *Bot) loadContactsForEvents() {
+	if !b.events.subscribed(EventContact) {
+		return
+	}
+	self := b.self
+	if self == nil || self.members != nil {
+		return
+	}
+	if _, err := self.Members(); err != nil {
+		return
+	}
+	// 联系人列表中的群组没有群成员, 批量获取详情之后原地更新
+	groups := self.members.Groups().AsMembers()
+	details := append(Members(nil), groups...)
+	if err := details.Detail(); err != nil {
+		return
+	}
+	for index, group := range groups {
+		*group = *details[index]
+		group.MemberList.init(self)
+	}
+}
+
+// diffContact 比较联系人变更前后的信息
+func diffContact(old, current *User) []*ContactEvent {
+	var events []*ContactEvent
+	var changes []FieldChange
+	for _, field := range []struct {
+		name     string
+		old, new string
+	}{
+		{FieldNickName, old.NickName, current.NickName},
+		{FieldRemarkName, old.RemarkName, current.RemarkName},
+		{FieldHeadImgUrl, old.HeadImgUrl, current.HeadImgUrl},
+	} {
+		if field.old != field.new {
+			changes = append(changes, FieldChange{Field: field.name, Old: field.old, New: field.new})
+		}
+	}
+	if !current.IsGroup() {
+		if len(changes) > 0 {
+			events = append(events, &ContactEvent{Type: ContactModified, Contact: current, Changes: changes})
+		}
+		return events
+	}
+	// 群组改名单独通知, 其他字段的变更作为 ContactModified
+	var others []FieldChange
+	for _, change := range changes {
+		if change.Field == FieldNickName {
+			events = append(events, &ContactEvent{Type: GroupRenamed, Contact: current, Changes: []FieldChange{change}})
+		} else {
+			others = append(others, change)
+		}
+	}
+	if len(others) > 0 {
+		events = append(events, &ContactEvent{Type: ContactModified, Contact: current, Changes: others})
+	}
+	// 之前没有获取过群成员时无法判断成员的变化
+	if len(old.MemberList) == 0 {
+		return events
+	}
+	previous := make(map[string]bool, len(old.MemberList))
+	for _, member := range old.MemberList {
+		previous[member.UserName] = true
+	}
+	for _, member := range current.MemberList {
+		if !previous[member.UserName] {
+			events = append(events, &ContactEvent{Type: GroupMemberJoined, Contact: current, Member: member})
+		}
+		delete(previous, member.UserName)
+	}
+	for _, member := range old.MemberList {
+		if previous[member.UserName] {
+			events = append(events, &ContactEvent{Type: GroupMemberLeft, Contact: current, Member: member})
+		}
+	}
+	return events
+}
@@ -5,6 +5,10 @@ import (
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 // Jar is a struct which as same as cookiejar.Jar
@@ -12,6 +16,31 @@ import (
 type Jar struct {
 	jar   *cookiejar.Jar
 	hosts map[string]*url.URL
+	// cookiejar.Jar 返回的 cookie 只包含名称和值, 所以需要单独记录域名、路径和过期时间等属性
+	entries map[cookieKey]cookieEntry
+	mu      sync.Mutex
+}
+
+// cookieKey 用于区分不同域名下的同名 cookie
+type cookieKey struct {
+	Domain string
+	Name   string
+}
+
+// cookieEntry 记录了 cookie 除了值之外的属性
+type cookieEntry struct {
+	Path     string
+	HostOnly bool // 没有设置 Domain, 只对设置它的域名有效
+	Secure   bool
+	HttpOnly bool
+	Expires  time.Time // 为零值时表示会话 cookie
+}
+
+// CookieExpiry 记录了一个 cookie 的过期时间
+type CookieExpiry struct {
+	Domain  string
+	Name    string
+	Expires time.Time
 }
 
 // UnmarshalJSON implements the json.Unmarshaler interface
@@ -28,28 +57,72 @@ func (j *Jar) UnmarshalJSON(bytes []byte) error {
 		if err != nil {
 			return err
 		}
-		j.jar.SetCookies(u, cs)
+		j.SetCookies(u, cs)
 	}
 	return nil
 }
 
 // MarshalJSON implements the json.Marshaler interface
 func (j *Jar) MarshalJSON() ([]byte, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
 	var cookies = make(map[string][]*http.Cookie)
 	for path, u := range j.hosts {
-		cookies[path] = append(cookies[path], j.jar.Cookies(u)...)
+		for _, cookie := range j.jar.Cookies(u) {
+			// 带上过期时间, 反序列化之后依然可以知道 cookie 何时过期
+			if expires, exist := j.expiry(u.Hostname(), cookie.Name); exist {
+				cookie.Expires = expires
+			}
+			// 带上域名, 反序列化之后依然会发送给子域名, 如 webpush.wx.qq.com
+			if key, entry, exist := j.lookup(u.Hostname(), cookie.Name); exist && !entry.HostOnly {
+				cookie.Domain, cookie.Path = key.Domain, entry.Path
+			}
+			cookies[path] = append(cookies[path], cookie)
+		}
 	}
 	return json.Marshal(cookies)
 }
 
 func (j *Jar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
 	if j.hosts == nil {
 		j.hosts = make(map[string]*url.URL)
 	}
+	if j.entries == nil {
+		j.entries = make(map[cookieKey]cookieEntry)
+	}
 	path := u.Scheme + "://" + u.Host
 	if _, exists := j.hosts[path]; !exists {
 		j.hosts[path] = u
 	}
+	now := time.Now()
+	for _, cookie := range cookies {
+		key := cookieKey{Domain: cookieDomain(u, cookie), Name: cookie.Name}
+		entry := cookieEntry{
+			Path:     cookie.Path,
+			HostOnly: cookie.Domain == "",
+			Secure:   cookie.Secure,
+			HttpOnly: cookie.HttpOnly,
+		}
+		if entry.Path == "" {
+			entry.Path = "/"
+		}
+		switch {
+		case cookie.MaxAge > 0:
+			entry.Expires = now.Add(time.Duration(cookie.MaxAge) * time.Second)
+		case cookie.MaxAge < 0:
+			delete(j.entries, key)
+			continue
+		case cookie.Expires.After(now):
+			entry.Expires = cookie.Expires
+		case !cookie.Expires.IsZero():
+			// 已经过期的 cookie 也会被 cookiejar.Jar 删除
+			delete(j.entries, key)
+			continue
+		}
+		j.entries[key] = entry
+	}
 	j.jar.SetCookies(u, cookies)
 }
 
@@ -57,11 +130,116 @@ func (j *Jar) Cookies(u *url.URL) []*http.Cookie {
 	return j.jar.Cookies(u)
 }
 
+// AllCookies 返回所有域名下的 cookie
+func (j *Jar) AllCookies() CookieGroup {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var cookies CookieGroup
+	for _, u := range j.hosts {
+		cookies = append(cookies, j.jar.Cookies(u)...)
+	}
+	return cookies
+}
+
+// copyDomain 将 from 域名下的 cookie 复制到 to 域名下, 用于切换域名之后继续使用当前的会话
+func (j *Jar) copyDomain(from, to WechatDomain) {
+	source, err := url.Parse(from.BaseHost())
+	if err != nil {
+		return
+	}
+	target, err := url.Parse(to.BaseHost())
+	if err != nil {
+		return
+	}
+	cookies := j.jar.Cookies(source)
+	j.mu.Lock()
+	for _, cookie := range cookies {
+		cookie.Domain, cookie.Path = string(to), "/"
+		if expires, exist := j.expiry(source.Hostname(), cookie.Name); exist {
+			cookie.Expires = expires
+		}
+	}
+	j.mu.Unlock()
+	j.SetCookies(target, cookies)
+}
+
+// clone 返回一个包含相同 cookie 的 Jar, 修改它不会影响原来的 Jar
+func (j *Jar) clone() *Jar {
+	jar := NewJar()
+	if data, err := j.MarshalJSON(); err == nil {
+		_ = jar.UnmarshalJSON(data)
+	}
+	return jar
+}
+
+// Expiries 返回所有记录了过期时间并且还没有过期的 cookie, 按照过期时间从早到晚排序
+func (j *Jar) Expiries() []CookieExpiry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	expiries := make([]CookieExpiry, 0, len(j.entries))
+	for key, entry := range j.entries {
+		if !entry.Expires.After(now) || !j.present(key, entry) {
+			continue
+		}
+		expiries = append(expiries, CookieExpiry{Domain: key.Domain, Name: key.Name, Expires: entry.Expires})
+	}
+	sort.Slice(expiries, func(i, k int) bool { return expiries[i].Expires.Before(expiries[k].Expires) })
+	return expiries
+}
+
+// present 判断 cookiejar.Jar 中是否还有这个 cookie, 过期的 cookie 会被它丢弃, 调用时必须持有锁
+func (j *Jar) present(key cookieKey, entry cookieEntry) bool {
+	u := &url.URL{Scheme: "https", Host: key.Domain, Path: entry.Path}
+	for _, cookie := range j.jar.Cookies(u) {
+		if cookie.Name == key.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// expiry 查找 host 下名为 name 的 cookie 的过期时间, 优先匹配最具体的域名
+func (j *Jar) expiry(host, name string) (expires time.Time, exist bool) {
+	var matched string
+	for key, entry := range j.entries {
+		if key.Name != name || entry.Expires.IsZero() || len(key.Domain) <= len(matched) {
+			continue
+		}
+		if host == key.Domain || strings.HasSuffix(host, "."+key.Domain) {
+			matched, expires, exist = key.Domain, entry.Expires, true
+		}
+	}
+	return expires, exist
+}
+
+// lookup 查找 host 下名为 name 的 cookie 的属性, 优先匹配最具体的域名
+func (j *Jar) lookup(host, name string) (key cookieKey, entry cookieEntry, exist bool) {
+	for k, e := range j.entries {
+		if k.Name != name || (exist && len(k.Domain) <= len(key.Domain)) {
+			continue
+		}
+		if host == k.Domain || strings.HasSuffix(host, "."+k.Domain) {
+			key, entry, exist = k, e, true
+		}
+	}
+	return key, entry, exist
+}
+
+// cookieDomain 返回 cookie 所属的域名, 没有设置 Domain 时为请求的域名
+func cookieDomain(u *url.URL, cookie *http.Cookie) string {
+	if cookie.Domain != "" {
+		return strings.TrimPrefix(cookie.Domain, ".")
+	}
+	return u.Hostname()
+}
+
 func NewJar() *Jar {
 	jar, _ := cookiejar.New(nil)
 	return &Jar{
-		jar:   jar,
-		hosts: make(map[string]*url.URL),
+		jar:     jar,
+		hosts:   make(map[string]*url.URL),
+		entries: make(map[cookieKey]cookieEntry),
 	}
 }
 
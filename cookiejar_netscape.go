@@ -0,0 +1,165 @@
+package openwechat
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// netscapeHttpOnlyPrefix curl 用这个前缀标记 HttpOnly 的 cookie
+const netscapeHttpOnlyPrefix = "#HttpOnly_"
+
+// jarCookie 是带有 HostOnly 属性的 cookie, http.Cookie 无法区分 Domain 是否被设置过
+type jarCookie struct {
+	*http.Cookie
+	HostOnly bool
+}
+
+// List 返回所有域名下的 cookie, 包含域名、路径和过期时间, 按照域名和名称排序
+// 会话 cookie 的 Expires 为零值
+func (j *Jar) List() []*http.Cookie {
+	records := j.records()
+	cookies := make([]*http.Cookie, len(records))
+	for i, record := range records {
+		cookies[i] = record.Cookie
+	}
+	return cookies
+}
+
+func (j *Jar) records() []jarCookie {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	records := make([]jarCookie, 0, len(j.entries))
+	for key, entry := range j.entries {
+		if cookie, exist := j.cookie(key, entry); exist {
+			records = append(records, jarCookie{Cookie: cookie, HostOnly: entry.HostOnly})
+		}
+	}
+	sort.Slice(records, func(i, k int) bool {
+		if records[i].Domain != records[k].Domain {
+			return records[i].Domain < records[k].Domain
+		}
+		return records[i].Name < records[k].Name
+	})
+	return records
+}
+
+// Lookup 返回所有域名下名为 name 的 cookie, 如 Lookup("wxsid")
+func (j *Jar) Lookup(name string) []*http.Cookie {
+	var cookies []*http.Cookie
+	for _, cookie := range j.List() {
+		if cookie.Name == name {
+			cookies = append(cookies, cookie)
+		}
+	}
+	return cookies
+}
+
+// cookie 根据记录的属性从 cookiejar.Jar 中查找 cookie 的值, 调用时必须持有锁
+func (j *Jar) cookie(key cookieKey, entry cookieEntry) (*http.Cookie, bool) {
+	u := &url.URL{Scheme: "https", Host: key.Domain, Path: entry.Path}
+	for _, cookie := range j.jar.Cookies(u) {
+		if cookie.Name != key.Name {
+			continue
+		}
+		return &http.Cookie{
+			Name:     key.Name,
+			Value:    cookie.Value,
+			Domain:   key.Domain,
+			Path:     entry.Path,
+			Expires:  entry.Expires,
+			Secure:   entry.Secure,
+			HttpOnly: entry.HttpOnly,
+		}, true
+	}
+	return nil, false
+}
+
+// PruneExpired 删除所有已经过期的 cookie, 返回删除的数量
+func (j *Jar) PruneExpired() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	var pruned int
+	for key, entry := range j.entries {
+		if entry.Expires.IsZero() || entry.Expires.After(now) {
+			continue
+		}
+		delete(j.entries, key)
+		pruned++
+	}
+	return pruned
+}
+
+// WriteNetscape 将所有的 cookie 以 Netscape cookies.txt 格式写入 writer, 可以直接给 curl 使用
+//
+//	curl -b cookies.txt https://wx.qq.com/...
+func (j *Jar) WriteNetscape(writer io.Writer) error {
+	buffer := bufio.NewWriter(writer)
+	_, _ = buffer.WriteString("# Netscape HTTP Cookie File\n# This file was generated by openwechat. Edit at your own risk.\n\n")
+	for _, cookie := range j.records() {
+		domain, includeSubdomains := cookie.Domain, "FALSE"
+		if !cookie.HostOnly {
+			domain, includeSubdomains = "."+domain, "TRUE"
+		}
+		if cookie.HttpOnly {
+			domain = netscapeHttpOnlyPrefix + domain
+		}
+		var expires int64
+		if !cookie.Expires.IsZero() {
+			expires = cookie.Expires.Unix()
+		}
+		_, _ = fmt.Fprintf(buffer, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			domain, includeSubdomains, cookie.Path, strings.ToUpper(strconv.FormatBool(cookie.Secure)), expires, cookie.Name, cookie.Value)
+	}
+	return buffer.Flush()
+}
+
+// ReadNetscape 从 reader 中读取 Netscape cookies.txt 格式的 cookie, 已经过期的 cookie 会被忽略
+func (j *Jar) ReadNetscape(reader io.Reader) error {
+	scanner := bufio.NewScanner(reader)
+	now := time.Now()
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		var httpOnly bool
+		if strings.HasPrefix(text, netscapeHttpOnlyPrefix) {
+			text, httpOnly = strings.TrimPrefix(text, netscapeHttpOnlyPrefix), true
+		}
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		if len(fields) != 7 {
+			return fmt.Errorf("netscape cookie line %d: expect 7 fields, got %d", line, len(fields))
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return fmt.Errorf("netscape cookie line %d: %w", line, err)
+		}
+		host := strings.TrimPrefix(fields[0], ".")
+		cookie := &http.Cookie{
+			Name:     fields[5],
+			Value:    fields[6],
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			HttpOnly: httpOnly,
+		}
+		if strings.EqualFold(fields[1], "TRUE") {
+			cookie.Domain = host
+		}
+		if expires > 0 {
+			cookie.Expires = time.Unix(expires, 0)
+			if !cookie.Expires.After(now) {
+				continue
+			}
+		}
+		j.SetCookies(&url.URL{Scheme: "https", Host: host, Path: cookie.Path}, []*http.Cookie{cookie})
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,73 @@
+package openwechat
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJarNetscape(t *testing.T) {
+	jar := NewJar()
+	u, _ := url.Parse("https://wx.qq.com/cgi-bin/mmwebwx-bin/webwxnewloginpage")
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	jar.SetCookies(u, []*http.Cookie{
+		{Name: "wxsid", Value: "sid", Domain: "wx.qq.com", Path: "/", Expires: expires},
+		{Name: "webwx_data_ticket", Value: "ticket", Domain: ".qq.com", Path: "/", Expires: expires, Secure: true},
+		{Name: "mm_lang", Value: "zh_CN", Path: "/", HttpOnly: true},
+	})
+	if cookies := jar.Lookup("webwx_data_ticket"); len(cookies) != 1 || cookies[0].Domain != "qq.com" || !cookies[0].Expires.Equal(expires) {
+		t.Fatalf("unexpected lookup result: %+v", cookies)
+	}
+
+	var buffer bytes.Buffer
+	if err := jar.WriteNetscape(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		".qq.com\tTRUE\t/\tTRUE\t",
+		".wx.qq.com\tTRUE\t/\tFALSE\t",
+		"#HttpOnly_wx.qq.com\tFALSE\t/\tFALSE\t0\tmm_lang\tzh_CN",
+	} {
+		if !strings.Contains(buffer.String(), line) {
+			t.Errorf("expect %q in:\n%s", line, buffer.String())
+		}
+	}
+
+	imported := NewJar()
+	if err := imported.ReadNetscape(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	file, _ := url.Parse("https://file.wx.qq.com/cgi-bin/mmwebwx-bin/webwxuploadmedia")
+	if ticket, err := wxDataTicket(imported.Cookies(file)); err != nil || ticket != "ticket" {
+		t.Errorf("unexpected data ticket on subdomain: %s %v", ticket, err)
+	}
+	if len(imported.List()) != 3 || len(imported.Expiries()) != 2 {
+		t.Errorf("unexpected imported cookies: %+v", imported.List())
+	}
+	if err := imported.ReadNetscape(strings.NewReader("wx.qq.com\tFALSE\t/\n")); err == nil {
+		t.Error("expect error for malformed line")
+	}
+}
+
+func TestJarPruneExpired(t *testing.T) {
+	jar := NewJar()
+	u, _ := url.Parse("https://wx.qq.com/")
+	jar.SetCookies(u, []*http.Cookie{
+		{Name: "short", Value: "1", Expires: time.Now().Add(time.Second)},
+		{Name: "long", Value: "2", Expires: time.Now().Add(time.Hour)},
+	})
+	jar.mu.Lock()
+	entry := jar.entries[cookieKey{Domain: "wx.qq.com", Name: "short"}]
+	entry.Expires = time.Now().Add(-time.Second)
+	jar.entries[cookieKey{Domain: "wx.qq.com", Name: "short"}] = entry
+	jar.mu.Unlock()
+	if pruned := jar.PruneExpired(); pruned != 1 {
+		t.Errorf("expect 1 pruned cookie, got %d", pruned)
+	}
+	if expiries := jar.Expiries(); len(expiries) != 1 || expiries[0].Name != "long" {
+		t.Errorf("unexpected expiries: %+v", expiries)
+	}
+}
@@ -0,0 +1,236 @@
+package openwechat
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// KeyProvider 为加密的热存储提供密钥
+// 密钥的长度必须为 16, 24 或 32 字节, 分别对应 AES-128, AES-192 和 AES-256
+type KeyProvider interface {
+	// CurrentKey 返回当前用于加密的密钥和它的 id
+	CurrentKey() (id string, key []byte, err error)
+	// Key 根据 id 返回用于解密的密钥
+	Key(id string) ([]byte, error)
+}
+
+// KeyRing 是一个基于内存的 KeyProvider, 支持密钥轮换
+type KeyRing struct {
+	mu      sync.RWMutex
+	current string
+	keys    map[string][]byte
+}
+
+// NewKeyRing 创建一个 KeyRing, id 对应的 key 作为当前的加密密钥
+func NewKeyRing(id string, key []byte) *KeyRing {
+	ring := &KeyRing{keys: make(map[string][]byte)}
+	ring.Rotate(id, key)
+	return ring
+}
+
+// Rotate 添加新的密钥并将其作为当前的加密密钥
+// 旧的密钥依然保留, 用于解密轮换之前写入的数据, 下一次写入时会使用新的密钥重新加密
+func (r *KeyRing) Rotate(id string, key []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys[id] = key
+	r.current = id
+}
+
+// CurrentKey 实现了 KeyProvider 接口
+func (r *KeyRing) CurrentKey() (string, []byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current, r.keys[r.current], nil
+}
+
+// Key 实现了 KeyProvider 接口
+func (r *KeyRing) Key(id string) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	key, exist := r.keys[id]
+	if !exist {
+		return nil, fmt.Errorf("key %q not found", id)
+	}
+	return key, nil
+}
+
+// encryptedStorageMagic 加密数据的文件头, 后面紧跟格式版本号
+const encryptedStorageMagic = "OWES"
+
+const encryptedStorageVersion byte = 1
+
+// AES-GCM 默认的 nonce 和认证标签长度
+const (
+	encryptedStorageNonceSize = 12
+	encryptedStorageTagSize   = 16
+)
+
+// validEncryptedData 在没有密钥的情况下检查加密数据的文件头和长度是否完整
+// 只能发现被截断的数据, 密文被修改只有解密时才能发现
+func validEncryptedData(data []byte) bool {
+	size := len(encryptedStorageMagic) + 2
+	if len(data) < size || string(data[:len(encryptedStorageMagic)]) != encryptedStorageMagic {
+		return false
+	}
+	if data[len(encryptedStorageMagic)] != encryptedStorageVersion {
+		return false
+	}
+	size += int(data[size-1])
+	// 明文至少包含一个字节
+	return len(data) > size+encryptedStorageNonceSize+encryptedStorageTagSize
+}
+
+// encryptedHotReloadStorage 使用 AES-GCM 加密的 HotReloadStorage
+// 数据格式为: magic | version | key id 长度 | key id | nonce | 密文
+// 除密文以外的部分作为附加数据参与认证, 任何部分被修改都会导致解密失败
+type encryptedHotReloadStorage struct {
+	storage  HotReloadStorage
+	provider KeyProvider
+	mu       sync.Mutex
+	reader   *bytes.Reader
+}
+
+// Read 第一次读取时会读出底层存储的全部数据并解密
+func (e *encryptedHotReloadStorage) Read(p []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.reader == nil {
+		data, err := io.ReadAll(e.storage)
+		if err != nil {
+			return 0, err
+		}
+		// 空的存储交给调用方按照 io.EOF 处理
+		if len(data) == 0 {
+			return 0, io.EOF
+		}
+		plaintext, err := e.decrypt(data)
+		if err != nil {
+			return 0, err
+		}
+		e.reader = bytes.NewReader(plaintext)
+	}
+	return e.reader.Read(p)
+}
+
+// Write 每次写入的数据都被视为一份完整的快照, 加密后一次性写入底层存储
+func (e *encryptedHotReloadStorage) Write(p []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	data, err := e.encrypt(p)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = e.storage.Write(data); err != nil {
+		return 0, err
+	}
+	e.reader = nil
+	return len(p), nil
+}
+
+// Seek 只支持回到开头重新读取, 底层存储实现了 io.Seeker 时会一并重置
+func (e *encryptedHotReloadStorage) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, errors.New("encrypted storage only supports seeking to start")
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.reader = nil
+	if seeker, ok := e.storage.(io.Seeker); ok {
+		return seeker.Seek(0, io.SeekStart)
+	}
+	return 0, nil
+}
+
+// Close 底层存储实现了 io.Closer 时关闭它
+func (e *encryptedHotReloadStorage) Close() error {
+	if closer, ok := e.storage.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (e *encryptedHotReloadStorage) encrypt(plaintext []byte) ([]byte, error) {
+	id, key, err := e.provider.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	if len(id) > 255 {
+		return nil, errors.New("key id too long")
+	}
+	aead, err := newStorageAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	header := append([]byte(encryptedStorageMagic), encryptedStorageVersion, byte(len(id)))
+	header = append(header, id...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	data := append(header, nonce...)
+	return aead.Seal(data, nonce, plaintext, header), nil
+}
+
+func (e *encryptedHotReloadStorage) decrypt(data []byte) ([]byte, error) {
+	size := len(encryptedStorageMagic) + 2
+	if len(data) < size || string(data[:len(encryptedStorageMagic)]) != encryptedStorageMagic {
+		return nil, fmt.Errorf("%w: missing header", ErrStorageTampered)
+	}
+	if version := data[len(encryptedStorageMagic)]; version != encryptedStorageVersion {
+		return nil, fmt.Errorf("unsupported encrypted storage version %d", version)
+	}
+	size += int(data[size-1])
+	if len(data) < size {
+		return nil, fmt.Errorf("%w: truncated header", ErrStorageTampered)
+	}
+	header := data[:size]
+	key, err := e.provider.Key(string(header[len(encryptedStorageMagic)+2:]))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newStorageAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < size+aead.NonceSize() {
+		return nil, fmt.Errorf("%w: truncated nonce", ErrStorageTampered)
+	}
+	nonce, ciphertext := data[size:size+aead.NonceSize()], data[size+aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, header)
+	if err != nil {
+		return nil, errors.Join(ErrStorageTampered, err)
+	}
+	return plaintext, nil
+}
+
+func newStorageAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Name 返回底层存储的名称, 底层存储没有名称时为空
+func (e *encryptedHotReloadStorage) Name() string {
+	name, _ := storageName(e.storage)
+	return name
+}
+
+// NewEncryptedHotReloadStorage 使用 AES-GCM 加密 storage 中的数据, 密钥由 provider 提供
+// 返回的 HotReloadStorage 可以直接用于 HotLogin, PushLogin 和 DumpHotReloadStorage
+//
+//	storage := openwechat.NewFileHotReloadStorage("storage.json")
+//	defer storage.Close()
+//	encrypted := openwechat.NewEncryptedHotReloadStorage(storage, openwechat.NewKeyRing("v1", key))
+//	bot.HotLogin(encrypted)
+func NewEncryptedHotReloadStorage(storage HotReloadStorage, provider KeyProvider) io.ReadWriteCloser {
+	return &encryptedHotReloadStorage{storage: storage, provider: provider}
+}
@@ -0,0 +1,92 @@
+package openwechat
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptedHotReloadStorage(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "storage.json")
+	ring := NewKeyRing("v1", bytes.Repeat([]byte{1}, 32))
+	storage := NewEncryptedHotReloadStorage(NewFileHotReloadStorage(filename), ring)
+	defer func() { _ = storage.Close() }()
+
+	item := HotReloadStorageItem{BaseRequest: &BaseRequest{Sid: "secret-sid", Skey: "secret-skey"}, UUID: "uuid"}
+	if err := json.NewEncoder(storage).Encode(item); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret-sid")) {
+		t.Fatal("storage is not encrypted")
+	}
+
+	var got HotReloadStorageItem
+	if _, err = storage.(io.Seeker).Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if err = json.NewDecoder(storage).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.BaseRequest.Sid != "secret-sid" || got.UUID != "uuid" {
+		t.Errorf("unexpected item: %+v", got)
+	}
+
+	// 轮换密钥之后依然可以读取旧的数据, 再次写入时使用新的密钥
+	ring.Rotate("v2", bytes.Repeat([]byte{2}, 16))
+	reader := NewEncryptedHotReloadStorage(NewFileHotReloadStorage(filename), ring)
+	defer func() { _ = reader.Close() }()
+	if err = json.NewDecoder(reader).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if err = json.NewEncoder(storage).Encode(item); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ = os.ReadFile(filename); !bytes.Contains(data, []byte("v2")) {
+		t.Error("expect data encrypted with rotated key")
+	}
+
+	// 修改密文之后无法解密
+	data[len(data)-1] ^= 0xFF
+	if err = os.WriteFile(filename, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	tampered := NewEncryptedHotReloadStorage(NewFileHotReloadStorage(filename), ring)
+	defer func() { _ = tampered.Close() }()
+	if err = json.NewDecoder(tampered).Decode(&got); !errors.Is(err, ErrStorageTampered) {
+		t.Errorf("expect ErrStorageTampered, got %v", err)
+	}
+}
+
+func TestEncryptedAtomicFileHotReloadStorage(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "storage.json")
+	ring := NewKeyRing("v1", bytes.Repeat([]byte{1}, 32))
+	storage := NewEncryptedHotReloadStorage(NewAtomicFileHotReloadStorage(filename, 2), ring)
+	for _, uuid := range []string{"first", "second"} {
+		if err := json.NewEncoder(storage).Encode(HotReloadStorageItem{UUID: uuid}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 模拟只写入了文件头和 nonce 的加密文件
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := len(encryptedStorageMagic) + 2 + len("v1") + encryptedStorageNonceSize
+	if err = os.WriteFile(filename, data[:size], 0600); err != nil {
+		t.Fatal(err)
+	}
+	var item HotReloadStorageItem
+	reader := NewEncryptedHotReloadStorage(NewAtomicFileHotReloadStorage(filename, 2), ring)
+	if err = json.NewDecoder(reader).Decode(&item); err != nil || item.UUID != "first" {
+		t.Errorf("expect fallback to previous generation, got %v %v", item.UUID, err)
+	}
+}
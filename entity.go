@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"strconv"
 )
 
 /*
@@ -25,11 +26,12 @@ func (l LoginInfo) Ok() bool {
 	return l.Ret == 0
 }
 
+// Err 返回的错误可以通过 errors.Is 判断对应的 Ret
 func (l LoginInfo) Err() error {
 	if l.Ok() {
 		return nil
 	}
-	return errors.New(l.Message)
+	return &APIError{Ret: Ret(l.Ret), ErrMsg: l.Message}
 }
 
 // BaseRequest 初始的请求信息
@@ -104,7 +106,9 @@ type WebWxSyncResponse struct {
 	SyncCheckKey           SyncKey
 	SyncKey                *SyncKey
 	BaseResponse           BaseResponse
-	ModChatRoomMemberList  Members
+	ModContactList         Members // 新增或者信息变更的联系人
+	DelContactList         Members // 被删除的联系人, 只有 UserName
+	ModChatRoomMemberList  Members // 成员发生变更的群组
 	AddMsgList             []*Message
 }
 
@@ -192,5 +196,6 @@ func (p PushLoginResponse) Err() error {
 	if p.Ok() {
 		return nil
 	}
-	return errors.New(p.Msg)
+	ret, _ := strconv.Atoi(p.Ret)
+	return &APIError{Endpoint: endpointName(webwxpushloginurl), Ret: Ret(ret), ErrMsg: p.Msg}
 }
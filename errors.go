@@ -2,8 +2,13 @@ package openwechat
 
 import (
 	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
 )
 
+// IsNetworkError 判断是否为网络错误, HTTP 5xx 也被视为网络错误
 func IsNetworkError(err error) bool {
 	return errors.Is(err, NetworkErr)
 }
@@ -41,8 +46,114 @@ var (
 
 	// ErrUserNotLogin define user not login
 	ErrUserNotLogin = errors.New("user not login")
+
+	// ErrStorageTampered define encrypted storage has been tampered or decrypted with a wrong key
+	ErrStorageTampered = errors.New("hot reload storage has been tampered")
+
+	// ErrHotReloadExpired define hot reload data is older than the max age
+	ErrHotReloadExpired = errors.New("hot reload data expired")
+
+	// ErrHotReloadCorrupt define hot reload data is incomplete or checksum mismatch
+	ErrHotReloadCorrupt = errors.New("hot reload data corrupt")
+
+	// ErrHotReloadVersion define hot reload data format version is not supported
+	ErrHotReloadVersion = errors.New("unsupported hot reload data version")
+
+	// ErrSessionLocked define hot reload session is held by another live process
+	ErrSessionLocked = errors.New("hot reload session is locked by another process")
+
+	// ErrSessionLeaseLost define session lease has been taken over by another process
+	ErrSessionLeaseLost = errors.New("session lease has been taken over")
+
+	// ErrModeNotRegistered define mode name passed to WithModeName is not registered
+	ErrModeNotRegistered = errors.New("mode is not registered")
 )
 
+// APIError 微信接口返回的错误, 所有 Caller 的方法在接口返回失败时都会返回它
+// Ret 不为零时可以通过 errors.Is 和 errors.As 判断, 如 errors.Is(err, openwechat.RetCookieInvalid)
+type APIError struct {
+	Endpoint   string // 接口名称, 为接口路径的最后一段, 如 webwxinit
+	Ret        Ret    // 接口返回的错误码, HTTP 请求失败时为零
+	ErrMsg     string // 接口返回的错误信息
+	StatusCode int    // HTTP 状态码
+}
+
+func (e *APIError) Error() string {
+	var builder strings.Builder
+	if e.Endpoint != "" {
+		builder.WriteString(e.Endpoint)
+		builder.WriteString(": ")
+	}
+	switch {
+	case e.Ret != 0:
+		_, _ = fmt.Fprintf(&builder, "%s (ret=%d)", e.Ret, int(e.Ret))
+	case e.StatusCode >= http.StatusBadRequest:
+		_, _ = fmt.Fprintf(&builder, "unexpected status %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	if e.ErrMsg != "" {
+		if e.Ret != 0 || e.StatusCode >= http.StatusBadRequest {
+			builder.WriteString(": ")
+		}
+		builder.WriteString(e.ErrMsg)
+	}
+	return builder.String()
+}
+
+// Is 让 HTTP 5xx 跟网络错误一样可以通过 errors.Is(err, NetworkErr) 判断
+// 这样重试、域名切换和断线重连都会把服务端的临时故障当作网络错误处理
+func (e *APIError) Is(target error) bool {
+	return target == NetworkErr && e.StatusCode >= http.StatusInternalServerError
+}
+
+// Unwrap 返回接口的错误码
+func (e *APIError) Unwrap() error {
+	if e.Ret == 0 {
+		return nil
+	}
+	return e.Ret
+}
+
+// newStatusError 请求成功但是 HTTP 状态码表示失败时的错误
+func newStatusError(resp *http.Response) *APIError {
+	return &APIError{Endpoint: endpointName(resp.Request.URL.Path), StatusCode: resp.StatusCode}
+}
+
+// withResponse 为接口返回的错误补充接口名称和 HTTP 状态码
+func withResponse(resp *http.Response, err error) error {
+	var apiError *APIError
+	if err == nil || !errors.As(err, &apiError) {
+		return err
+	}
+	if apiError.Endpoint == "" {
+		apiError.Endpoint = endpointName(resp.Request.URL.Path)
+	}
+	if apiError.StatusCode == 0 {
+		apiError.StatusCode = resp.StatusCode
+	}
+	return err
+}
+
+// endpointName 返回接口路径的最后一段
+func endpointName(p string) string {
+	return path.Base(p)
+}
+
+// IsRetryable 判断错误是否可以通过重试恢复, 如网络错误, 系统错误, 请求过于频繁和服务端的 5xx 错误
+func IsRetryable(err error) bool {
+	return IsNetworkError(err) || IsRateLimited(err) || errors.Is(err, RetSysError)
+}
+
+// IsSessionExpired 判断错误是否表示会话已经失效, 需要重新登录
+func IsSessionExpired(err error) bool {
+	return errors.Is(err, RetFailedLoginWarn) || errors.Is(err, RetFailedLoginCheck) || errors.Is(err, RetCookieInvalid)
+}
+
+// IsRateLimited 判断错误是否因为操作过于频繁
+func IsRateLimited(err error) bool {
+	var apiError *APIError
+	return errors.Is(err, RetOptTooOften) || errors.As(err, &apiError) && apiError.StatusCode == http.StatusTooManyRequests
+}
+
 // Error impl error interface
 func (r Ret) Error() string {
 	return r.String()
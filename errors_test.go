@@ -2,6 +2,8 @@ package openwechat
 
 import (
 	"errors"
+	"fmt"
+	"net/http"
 	"testing"
 )
 
@@ -12,3 +14,50 @@ func TestIsNetworkError(t *testing.T) {
 		t.Error("err is not network error")
 	}
 }
+
+func TestAPIError(t *testing.T) {
+	var err error = &APIError{Endpoint: "webwxsendmsg", Ret: RetOptTooOften, ErrMsg: "too often"}
+	if !errors.Is(err, RetOptTooOften) || !IsRateLimited(err) || !IsRetryable(err) || IsSessionExpired(err) {
+		t.Errorf("unexpected classification of %v", err)
+	}
+	if err.Error() != "webwxsendmsg: operate too often (ret=1205): too often" {
+		t.Errorf("unexpected error message: %s", err)
+	}
+	err = fmt.Errorf("sync check failed: %w", &APIError{Endpoint: "synccheck", Ret: RetCookieInvalid})
+	var ret Ret
+	if !IsSessionExpired(err) || IsRetryable(err) || !errors.As(err, &ret) || ret != RetCookieInvalid {
+		t.Errorf("unexpected classification of %v", err)
+	}
+	err = &APIError{Endpoint: "webwxinit", StatusCode: http.StatusBadGateway}
+	if !IsRetryable(err) || errors.As(err, &ret) || err.Error() != "webwxinit: unexpected status 502 Bad Gateway" {
+		t.Errorf("unexpected classification of %v", err)
+	}
+}
+
+func TestExitKindReconnectable(t *testing.T) {
+	var cases = map[ExitKind]bool{
+		ExitUnknown:           false,
+		ExitPhoneLogout:       false,
+		ExitLoggedInElsewhere: false,
+		ExitCookieInvalid:     true,
+		ExitUserLogout:        false,
+		ExitContextCanceled:   false,
+		ExitNetworkFailure:    true,
+	}
+	for kind, want := range cases {
+		if got := kind.Reconnectable(); got != want {
+			t.Errorf("%s: expected reconnectable %v, got %v", kind, want, got)
+		}
+	}
+}
+
+func TestServerErrorIsNetworkError(t *testing.T) {
+	var err error = fmt.Errorf("sync check failed: %w", &APIError{Endpoint: "synccheck", StatusCode: http.StatusServiceUnavailable})
+	if !IsNetworkError(err) || !IsRetryable(err) || !DefaultRecoverable(err) {
+		t.Errorf("expect 5xx to be a network error: %v", err)
+	}
+	err = &APIError{Endpoint: "synccheck", StatusCode: http.StatusNotFound}
+	if IsNetworkError(err) || IsRetryable(err) || DefaultRecoverable(err) {
+		t.Errorf("expect 4xx not to be a network error: %v", err)
+	}
+}
@@ -0,0 +1,280 @@
+package openwechat
+
+import (
+	"log"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType 定义了 Bot 发布的事件类型
+type EventType int
+
+const (
+	// EventUUID 获取到了登录二维码的 uuid, 对应 UUIDCallback
+	EventUUID EventType = iota + 1
+	// EventUUIDExpired 登录二维码过期, 对应 UUIDExpiredCallback
+	EventUUIDExpired
+	// EventScan 用户扫码, 还没有确认登录, 对应 ScanCallBack
+	EventScan
+	// EventConfirm 用户在手机上确认了扫码登录, 对应 LoginCallBack, 在 EventLogin 之后发布
+	EventConfirm
+	// EventLogin 登录成功并且完成了初始化, 包括热登录、免扫码登录和重新登录
+	EventLogin
+	// EventSyncCheck 同步检查的心跳, 对应 SyncCheckCallback
+	EventSyncCheck
+	// EventSyncBacklog 一次同步检查之后因为 ContinueFlag 连续拉取了多轮数据
+	EventSyncBacklog
+	// EventMessage 收到了新消息, 对应 MessageHandler
+	EventMessage
+	// EventContact 联系人发生了变更, 对应 OnContactEvent
+	EventContact
+	// EventExit Bot 退出, 对应 LogoutCallBack
+	EventExit
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventUUID:
+		return "UUID"
+	case EventUUIDExpired:
+		return "UUIDExpired"
+	case EventScan:
+		return "Scan"
+	case EventConfirm:
+		return "Confirm"
+	case EventLogin:
+		return "Login"
+	case EventSyncCheck:
+		return "SyncCheck"
+	case EventSyncBacklog:
+		return "SyncBacklog"
+	case EventMessage:
+		return "Message"
+	case EventContact:
+		return "Contact"
+	case EventExit:
+		return "Exit"
+	default:
+		return "Unknown"
+	}
+}
+
+// Event 是 Bot 发布的事件, 根据 Type 读取对应的字段
+type Event struct {
+	Type EventType
+	Time time.Time
+	Bot  *Bot
+
+	UUID          string             // EventUUID 和 EventUUIDExpired
+	LoginResponse CheckLoginResponse // EventScan 和 EventConfirm
+	SyncCheck     *SyncCheckResponse // EventSyncCheck
+	Backlog       *SyncBacklog       // EventSyncBacklog
+	Message       *Message           // EventMessage
+	Contact       *ContactEvent      // EventContact
+	Err           error              // EventExit 的退出原因, 跟 CrashReason 相同, 主动退出时为 nil
+}
+
+// EventHandler 处理事件的函数
+type EventHandler func(event *Event)
+
+// Subscription 代表一个订阅, 用于取消订阅
+type Subscription struct {
+	handler   EventHandler
+	types     []EventType
+	cancelled atomic.Bool
+}
+
+func (s *Subscription) accept(t EventType) bool {
+	if s.cancelled.Load() {
+		return false
+	}
+	if len(s.types) == 0 {
+		return true
+	}
+	for _, item := range s.types {
+		if item == t {
+			return true
+		}
+	}
+	return false
+}
+
+// eventBus 在发布事件的 goroutine 中同步投递事件, 同一时间只有一个 goroutine 在投递
+// 正在投递时发布的事件会加入队列, 由正在投递的 goroutine 在当前事件投递完之后继续投递
+type eventBus struct {
+	mu            sync.Mutex
+	subscriptions []*Subscription
+	queue         []*Event
+	deliverMu     sync.Mutex // 投递事件时持有
+}
+
+func (e *eventBus) subscribe(handler EventHandler, types ...EventType) *Subscription {
+	sub := &Subscription{handler: handler, types: types}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.subscriptions = append(e.subscriptions, sub)
+	return sub
+}
+
+func (e *eventBus) unsubscribe(sub *Subscription) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for index, item := range e.subscriptions {
+		if item == sub {
+			sub.cancelled.Store(true)
+			e.subscriptions = append(e.subscriptions[:index:index], e.subscriptions[index+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// subscribed 判断是否有订阅了 t 类型事件的订阅者, 不包括 Bot 的回调
+func (e *eventBus) subscribed(t EventType) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, sub := range e.subscriptions {
+		if len(sub.types) > 0 && sub.accept(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// publish 投递事件, 其他 goroutine 正在投递时等待它完成, 返回时事件已经投递给了所有的订阅者
+// 不能在处理函数中调用, 否则会死锁
+func (e *eventBus) publish(event *Event) {
+	e.enqueue(event)
+	e.dispatch(true)
+}
+
+// tryPublish 没有正在进行的投递时与 publish 相同, 否则只将事件加入队列, 由正在投递的 goroutine 投递
+// 可以在处理函数中调用
+func (e *eventBus) tryPublish(event *Event) {
+	e.enqueue(event)
+	e.dispatch(false)
+}
+
+func (e *eventBus) enqueue(event *Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.queue = append(e.queue, event)
+}
+
+// next 取出队列中的第一个事件和当前的订阅者, 队列为空时返回 nil
+func (e *eventBus) next() (*Event, []*Subscription) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.queue) == 0 {
+		return nil, nil
+	}
+	event := e.queue[0]
+	e.queue = e.queue[1:]
+	return event, e.subscriptions
+}
+
+// dispatch 投递队列中的事件, wait 为 false 时其他 goroutine 正在投递则直接返回
+func (e *eventBus) dispatch(wait bool) {
+	for {
+		if wait {
+			e.deliverMu.Lock()
+		} else if !e.deliverMu.TryLock() {
+			return
+		}
+		for event, subscriptions := e.next(); event != nil; event, subscriptions = e.next() {
+			for _, sub := range subscriptions {
+				if sub.accept(event.Type) {
+					sub.deliver(event)
+				}
+			}
+		}
+		e.deliverMu.Unlock()
+		// 释放锁之前加入队列的事件, 发布它的 goroutine 可能因为没有拿到锁而直接返回
+		e.mu.Lock()
+		pending := len(e.queue) > 0
+		e.mu.Unlock()
+		if !pending {
+			return
+		}
+		wait = false
+	}
+}
+
+// deliver 调用处理函数, 处理函数 panic 时不会影响其他订阅者和消息同步
+func (s *Subscription) deliver(event *Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("openwechat: %s event handler panic: %v\n%s", event.Type, r, debug.Stack())
+		}
+	}()
+	s.handler(event)
+}
+
+// Subscribe 订阅事件, 不指定类型时订阅所有的事件
+// 处理函数在发布事件的 goroutine 中同步调用: 登录相关的事件在调用登录方法的 goroutine 中, 消息、联系人变更和同步检查的事件在消息同步的 goroutine 中.
+// 同一时间只投递一个事件, 一个事件投递给所有的订阅者之后才会投递下一个事件, 订阅者按照订阅的顺序调用,
+// Bot 的回调字段如 MessageHandler 总是最先调用.
+// 调用 Exit 时没有其他事件正在投递, EventExit 在 Exit 返回之前投递; 否则, 包括在处理函数中调用 Exit,
+// EventExit 由正在投递的 goroutine 在当前事件处理完之后投递.
+// 处理函数 panic 时会被恢复并记录日志, 不会影响其他的订阅者.
+//
+//	sub := bot.Subscribe(func(event *openwechat.Event) {
+//		fmt.Println(event.Message.Content)
+//	}, openwechat.EventMessage)
+//	defer bot.Unsubscribe(sub)
+func (b *Bot) Subscribe(handler EventHandler, types ...EventType) *Subscription {
+	return b.events.subscribe(handler, types...)
+}
+
+// Unsubscribe 取消订阅, 已经在队列中的事件也不会再投递给它, 返回是否取消成功
+func (b *Bot) Unsubscribe(sub *Subscription) bool {
+	return b.events.unsubscribe(sub)
+}
+
+// publish 发布一个事件, 返回时事件已经投递给了所有的订阅者
+func (b *Bot) publish(event *Event) {
+	event.Bot, event.Time = b, time.Now()
+	b.events.publish(event)
+}
+
+// tryPublish 发布一个可能在处理函数中发布的事件, 见 eventBus.tryPublish
+func (b *Bot) tryPublish(event *Event) {
+	event.Bot, event.Time = b, time.Now()
+	b.events.tryPublish(event)
+}
+
+// dispatchCallbacks 将事件转换为 Bot 回调字段的调用, 在 NewBot 中作为第一个订阅者
+func (b *Bot) dispatchCallbacks(event *Event) {
+	switch event.Type {
+	case EventUUID:
+		if cb := b.UUIDCallback; cb != nil {
+			cb(event.UUID)
+		}
+	case EventUUIDExpired:
+		if cb := b.UUIDExpiredCallback; cb != nil {
+			cb(event.UUID)
+		}
+	case EventScan:
+		if cb := b.ScanCallBack; cb != nil {
+			cb(event.LoginResponse)
+		}
+	case EventConfirm:
+		if cb := b.LoginCallBack; cb != nil {
+			cb(event.LoginResponse)
+		}
+	case EventSyncCheck:
+		if cb := b.SyncCheckCallback; cb != nil {
+			cb(*event.SyncCheck)
+		}
+	case EventMessage:
+		if handler := b.MessageHandler; handler != nil {
+			handler(event.Message)
+		}
+	case EventExit:
+		if cb := b.LogoutCallBack; cb != nil {
+			cb(b)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package openwechat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ExitKind 定义了 Bot 退出的原因
+type ExitKind int
+
+const (
+	// ExitUnknown 其他原因, 如消息处理函数 panic 或者 MessageErrorHandler 返回的错误
+	ExitUnknown ExitKind = iota
+	// ExitPhoneLogout 用户在手机上退出了网页版微信, synccheck 返回 1101
+	ExitPhoneLogout
+	// ExitLoggedInElsewhere 账号在其他地方登录了网页版微信, synccheck 返回 1100
+	ExitLoggedInElsewhere
+	// ExitCookieInvalid cookie 已经失效, synccheck 返回 1102
+	ExitCookieInvalid
+	// ExitUserLogout 调用了 Bot.Logout
+	ExitUserLogout
+	// ExitContextCanceled 创建 Bot 时传入的 context 被取消或者超时
+	ExitContextCanceled
+	// ExitNetworkFailure 消息同步发生网络错误并且没有恢复
+	ExitNetworkFailure
+)
+
+func (k ExitKind) String() string {
+	switch k {
+	case ExitPhoneLogout:
+		return "手机端退出"
+	case ExitLoggedInElsewhere:
+		return "在其他地方登录"
+	case ExitCookieInvalid:
+		return "cookie 失效"
+	case ExitUserLogout:
+		return "主动退出登录"
+	case ExitContextCanceled:
+		return "context 被取消"
+	case ExitNetworkFailure:
+		return "网络错误"
+	default:
+		return "未知原因"
+	}
+}
+
+// Reconnectable 判断这种原因导致的退出是否值得尝试重新登录
+// 手机端退出、主动退出和 context 被取消都是用户的意图, 不应该重新登录
+// 在其他地方登录之后重新登录只会和对方互相挤下线, 与 DefaultRecoverable 一致
+func (k ExitKind) Reconnectable() bool {
+	switch k {
+	case ExitCookieInvalid, ExitNetworkFailure:
+		return true
+	default:
+		return false
+	}
+}
+
+// ExitReason 是 Bot.Block 和 Bot.CrashReason 返回的错误, 包含了退出的原因和原始的错误
+//
+//	var reason *openwechat.ExitReason
+//	if err := bot.Block(); errors.As(err, &reason) && reason.Kind == openwechat.ExitPhoneLogout {
+//		// 用户在手机上退出了
+//	}
+type ExitReason struct {
+	Kind ExitKind
+	Err  error
+}
+
+func (e *ExitReason) Error() string {
+	return fmt.Sprintf("%s: %v", e.Kind, e.Err)
+}
+
+// Unwrap 返回原始的错误, 可以继续使用 errors.Is 和 errors.As 判断
+func (e *ExitReason) Unwrap() error {
+	return e.Err
+}
+
+// newExitReason 根据导致退出的错误判断退出的原因
+func newExitReason(err error) *ExitReason {
+	if err == nil {
+		return nil
+	}
+	var reason *ExitReason
+	if errors.As(err, &reason) {
+		return reason
+	}
+	return &ExitReason{Kind: exitKind(err), Err: err}
+}
+
+func exitKind(err error) ExitKind {
+	var ret Ret
+	switch {
+	case errors.Is(err, ErrUserLogout):
+		return ExitUserLogout
+	case errors.As(err, &ret):
+		switch ret {
+		case failedLoginCheck:
+			return ExitPhoneLogout
+		case failedLoginWarn:
+			return ExitLoggedInElsewhere
+		case cookieInvalid:
+			return ExitCookieInvalid
+		}
+	case IsNetworkError(err):
+		return ExitNetworkFailure
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return ExitContextCanceled
+	}
+	return ExitUnknown
+}
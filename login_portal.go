@@ -0,0 +1,285 @@
+package openwechat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sync"
+)
+
+// LoginState 定义了 LoginPortal 推送的登录状态
+type LoginState string
+
+const (
+	// LoginStateIdle 还没有开始登录
+	LoginStateIdle LoginState = "idle"
+	// LoginStateWaiting 等待扫码
+	LoginStateWaiting LoginState = "waiting"
+	// LoginStateScanned 已扫码, 等待手机确认
+	LoginStateScanned LoginState = "scanned"
+	// LoginStateConfirmed 登录成功
+	LoginStateConfirmed LoginState = "confirmed"
+	// LoginStateExpired 二维码已过期
+	LoginStateExpired LoginState = "expired"
+	// LoginStateFailed 登录失败
+	LoginStateFailed LoginState = "failed"
+)
+
+// LoginEvent 描述了一次登录状态的变更
+type LoginEvent struct {
+	State  LoginState `json:"state"`
+	UUID   string     `json:"uuid,omitempty"`
+	Avatar string     `json:"avatar,omitempty"` // 扫码用户的头像, data url 格式
+	Error  string     `json:"error,omitempty"`
+}
+
+// ErrLoginRunning 登录正在进行中或者已经登录成功
+var ErrLoginRunning = errors.New("login is running")
+
+// LoginPortal 是一个 http.Handler, 用于在无法打开浏览器的服务器上通过网页扫码登录
+// 它提供以下接口, 可以通过 http.StripPrefix 挂载到任意路径下:
+//
+//	GET  /            登录页面
+//	GET  /qrcode.png  当前的登录二维码, 也支持 /qrcode.svg
+//	GET  /events      通过 Server-Sent Events 推送登录状态的变更
+//	POST /login       开始一次新的扫码登录
+//
+// LoginPortal 通过 Bot.Subscribe 订阅登录事件获取登录状态, 不会修改 Bot 的回调字段.
+// 注意: 任何能访问 LoginPortal 的人都可以扫码登录这个账号, 不要把它暴露在公网上,
+// 需要时通过 Authorize 校验请求
+//
+//	portal := openwechat.NewLoginPortal(bot)
+//	portal.Authorize = func(r *http.Request) bool { return r.Header.Get("X-Token") == token }
+//	http.Handle("/wechat/", http.StripPrefix("/wechat", portal))
+type LoginPortal struct {
+	// Authorize 校验每一个请求, 返回 false 时响应 403, 为空时不做校验
+	Authorize func(r *http.Request) bool
+
+	bot          *Bot
+	mux          *http.ServeMux
+	mu           sync.Mutex
+	current      LoginEvent
+	running      bool
+	subscribers  map[chan LoginEvent]struct{}
+	subscription *Subscription
+}
+
+// NewLoginPortal 创建一个 LoginPortal, 并订阅 bot 的登录事件
+func NewLoginPortal(bot *Bot) *LoginPortal {
+	p := &LoginPortal{
+		bot:         bot,
+		current:     LoginEvent{State: LoginStateIdle},
+		subscribers: make(map[chan LoginEvent]struct{}),
+	}
+	p.subscription = bot.Subscribe(p.handleEvent, EventUUID, EventScan, EventConfirm, EventUUIDExpired)
+	p.mux = http.NewServeMux()
+	p.mux.HandleFunc("/", p.handleIndex)
+	p.mux.HandleFunc("/qrcode.png", p.handleQrcode)
+	p.mux.HandleFunc("/qrcode.svg", p.handleQrcode)
+	p.mux.HandleFunc("/events", p.handleEvents)
+	p.mux.HandleFunc("/login", p.handleLogin)
+	return p
+}
+
+// handleEvent 将 bot 的登录事件转换为 LoginEvent
+func (p *LoginPortal) handleEvent(event *Event) {
+	switch event.Type {
+	case EventUUID:
+		p.publish(LoginEvent{State: LoginStateWaiting, UUID: event.UUID})
+	case EventScan:
+		avatar, _ := event.LoginResponse.Avatar()
+		p.publish(LoginEvent{State: LoginStateScanned, UUID: p.bot.UUID(), Avatar: avatar})
+	case EventConfirm:
+		p.publish(LoginEvent{State: LoginStateConfirmed, UUID: p.bot.UUID()})
+	case EventUUIDExpired:
+		p.publish(LoginEvent{State: LoginStateExpired, UUID: event.UUID})
+	}
+}
+
+// Close 取消订阅 bot 的登录事件, 之后 LoginPortal 不再更新登录状态
+func (p *LoginPortal) Close() {
+	p.bot.Unsubscribe(p.subscription)
+}
+
+// State 返回当前的登录状态
+func (p *LoginPortal) State() LoginEvent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.current
+}
+
+func (p *LoginPortal) publish(event LoginEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current = event
+	for ch := range p.subscribers {
+		// 客户端太慢时丢弃事件, 不能阻塞登录过程
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+func (p *LoginPortal) subscribe() (chan LoginEvent, LoginEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ch := make(chan LoginEvent, 16)
+	p.subscribers[ch] = struct{}{}
+	return ch, p.current
+}
+
+func (p *LoginPortal) unsubscribe(ch chan LoginEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.subscribers, ch)
+}
+
+// StartLogin 在后台开始一次新的扫码登录
+// 登录正在进行中或者 bot 已经登录成功时返回 ErrLoginRunning
+func (p *LoginPortal) StartLogin() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.running || p.bot.Alive() {
+		return ErrLoginRunning
+	}
+	p.running = true
+	go p.runLogin()
+	return nil
+}
+
+func (p *LoginPortal) runLogin() {
+	err := p.bot.Login()
+	p.mu.Lock()
+	p.running = false
+	p.mu.Unlock()
+	// 二维码过期时已经通过 EventUUIDExpired 推送过状态
+	if err != nil && !errors.Is(err, ErrLoginTimeout) {
+		p.publish(LoginEvent{State: LoginStateFailed, UUID: p.bot.UUID(), Error: err.Error()})
+	}
+}
+
+// ServeHTTP 实现了 http.Handler 接口
+func (p *LoginPortal) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.Authorize != nil && !p.Authorize(r) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	p.mux.ServeHTTP(w, r)
+}
+
+func (p *LoginPortal) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_ = loginPortalPage.Execute(w, nil)
+}
+
+func (p *LoginPortal) handleQrcode(w http.ResponseWriter, r *http.Request) {
+	event := p.State()
+	if event.UUID == "" || event.State != LoginStateWaiting && event.State != LoginStateScanned {
+		http.Error(w, "no qrcode available", http.StatusNotFound)
+		return
+	}
+	q, err := NewLoginQrcode(event.UUID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if r.URL.Path == "/qrcode.svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		_ = q.WriteSVG(w, 8)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	_ = q.WritePNG(w, 8)
+}
+
+func (p *LoginPortal) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch, current := p.subscribe()
+	defer p.unsubscribe(ch)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	event := current
+	for {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return
+		}
+		if _, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.State, data); err != nil {
+			return
+		}
+		flusher.Flush()
+		select {
+		case event = <-ch:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (p *LoginPortal) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := p.StartLogin(); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// loginPortalPage 登录页面, 所有的地址都是相对路径, 以便挂载到任意路径下
+var loginPortalPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>微信登录</title>
+<style>
+body { font-family: sans-serif; text-align: center; margin-top: 40px; }
+img { width: 240px; height: 240px; }
+#avatar { width: 64px; height: 64px; border-radius: 8px; }
+</style>
+</head>
+<body>
+<h2 id="state">正在连接...</h2>
+<div><img id="qrcode" alt="" hidden></div>
+<div><img id="avatar" alt="" hidden></div>
+<p id="error"></p>
+<button id="login">扫码登录</button>
+<script>
+var texts = {idle: "未登录", waiting: "请使用手机微信扫码", scanned: "已扫码, 请在手机上确认登录", confirmed: "登录成功", expired: "二维码已过期", failed: "登录失败"};
+var qrcode = document.getElementById("qrcode"), avatar = document.getElementById("avatar");
+var button = document.getElementById("login");
+var events = new EventSource("events");
+Object.keys(texts).forEach(function (state) {
+	events.addEventListener(state, function (e) {
+		var event = JSON.parse(e.data);
+		document.getElementById("state").textContent = texts[event.state];
+		document.getElementById("error").textContent = event.error || "";
+		qrcode.hidden = event.state !== "waiting";
+		if (!qrcode.hidden) { qrcode.src = "qrcode.png?uuid=" + encodeURIComponent(event.uuid); }
+		avatar.hidden = !event.avatar;
+		if (event.avatar) { avatar.src = event.avatar; }
+		button.disabled = event.state === "waiting" || event.state === "scanned" || event.state === "confirmed";
+	});
+});
+button.onclick = function () { fetch("login", {method: "POST"}); };
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,176 @@
+package openwechat
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MessageDeduplicator 根据消息 id 过滤重复的消息
+// 断线重连或者使用较旧的 SyncKey 热登录之后, webwxsync 可能会再次推送已经处理过的消息
+// 它记录最近处理过的消息 id, 超过容量时淘汰最久没有出现的 id, 超过 TTL 的 id 会被忽略
+//
+//	dedup := openwechat.NewMessageDeduplicator(10000, 24*time.Hour)
+//	dedup.Storage = openwechat.NewAtomicFileHotReloadStorage("msgids.json", 1)
+//	bot := openwechat.DefaultBot(openwechat.WithMessageDeduplicator(dedup))
+type MessageDeduplicator struct {
+	// Capacity 最多记录的消息数量, 为零时为 10000
+	Capacity int
+
+	// TTL 消息 id 的保留时间, 为零时为 24 小时
+	TTL time.Duration
+
+	// Storage 持久化消息 id 的存储, 重启之后依然可以过滤重复的消息, 为空时只保存在内存中
+	// 每次同步检查的消息处理完之后写入一次
+	// 每次写入都是一份完整的快照, 可以使用 NewFileHotReloadStorage 或者 NewAtomicFileHotReloadStorage
+	Storage io.ReadWriter
+
+	mu      sync.Mutex
+	entries *list.List // 最近出现的 id 在前面
+	index   map[string]*list.Element
+	loaded  bool
+	dirty   bool
+}
+
+// seenMessage 记录了一个消息 id 最近一次出现的时间
+type seenMessage struct {
+	ID   string    `json:"id"`
+	Seen time.Time `json:"seen"`
+}
+
+// NewMessageDeduplicator 创建一个最多记录 capacity 个消息 id, 每个 id 保留 ttl 的 MessageDeduplicator
+func NewMessageDeduplicator(capacity int, ttl time.Duration) *MessageDeduplicator {
+	return &MessageDeduplicator{Capacity: capacity, TTL: ttl}
+}
+
+func (d *MessageDeduplicator) capacity() int {
+	if d.Capacity > 0 {
+		return d.Capacity
+	}
+	return 10000
+}
+
+func (d *MessageDeduplicator) ttl() time.Duration {
+	if d.TTL > 0 {
+		return d.TTL
+	}
+	return 24 * time.Hour
+}
+
+// Duplicate 判断消息是否已经处理过, 没有处理过时记录它的 id
+// 优先使用 NewMsgId, 没有 id 的消息不会被过滤
+func (d *MessageDeduplicator) Duplicate(msg *Message) bool {
+	id := msg.MsgId
+	if msg.NewMsgId != 0 {
+		id = strconv.FormatInt(msg.NewMsgId, 10)
+	}
+	if id == "" {
+		return false
+	}
+	return d.Seen(id)
+}
+
+// Seen 判断 id 是否在 TTL 内出现过, 并且记录这一次出现
+func (d *MessageDeduplicator) Seen(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.load()
+	now := time.Now()
+	d.prune(now)
+	d.dirty = true
+	if element, exist := d.index[id]; exist {
+		element.Value.(*seenMessage).Seen = now
+		d.entries.MoveToFront(element)
+		return true
+	}
+	d.index[id] = d.entries.PushFront(&seenMessage{ID: id, Seen: now})
+	for d.entries.Len() > d.capacity() {
+		d.remove(d.entries.Back())
+	}
+	return false
+}
+
+// Len 返回当前记录的消息 id 数量
+func (d *MessageDeduplicator) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.load()
+	d.prune(time.Now())
+	return d.entries.Len()
+}
+
+// Flush 将记录的消息 id 写入 Storage, 没有变化时不会写入
+func (d *MessageDeduplicator) Flush() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.Storage == nil || !d.dirty {
+		return nil
+	}
+	d.prune(time.Now())
+	// 从旧到新保存, 加载时依次放到最前面
+	records := make([]*seenMessage, 0, d.entries.Len())
+	for element := d.entries.Back(); element != nil; element = element.Prev() {
+		records = append(records, element.Value.(*seenMessage))
+	}
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	if _, err = d.Storage.Write(data); err != nil {
+		return err
+	}
+	d.dirty = false
+	return nil
+}
+
+// load 第一次使用时从 Storage 中加载, 存储为空或者数据损坏时从空的记录开始, 调用时必须持有锁
+func (d *MessageDeduplicator) load() {
+	if d.loaded {
+		return
+	}
+	d.loaded = true
+	d.entries, d.index = list.New(), make(map[string]*list.Element)
+	if d.Storage == nil {
+		return
+	}
+	var records []*seenMessage
+	if err := json.NewDecoder(d.Storage).Decode(&records); err != nil && !errors.Is(err, io.EOF) {
+		return
+	}
+	for _, record := range records {
+		if element, exist := d.index[record.ID]; exist {
+			d.remove(element)
+		}
+		d.index[record.ID] = d.entries.PushFront(record)
+	}
+	for d.entries.Len() > d.capacity() {
+		d.remove(d.entries.Back())
+	}
+}
+
+// prune 删除超过 TTL 的 id, 最久没有出现的 id 在最后面, 调用时必须持有锁
+func (d *MessageDeduplicator) prune(now time.Time) {
+	ttl := d.ttl()
+	for element := d.entries.Back(); element != nil; element = d.entries.Back() {
+		if now.Sub(element.Value.(*seenMessage).Seen) <= ttl {
+			return
+		}
+		d.remove(element)
+		d.dirty = true
+	}
+}
+
+func (d *MessageDeduplicator) remove(element *list.Element) {
+	d.entries.Remove(element)
+	delete(d.index, element.Value.(*seenMessage).ID)
+}
+
+// WithMessageDeduplicator 是一个 BotPreparerFunc，用于设置过滤重复消息的 MessageDeduplicator
+// 默认使用只保存在内存中的 MessageDeduplicator, 传入 nil 时不过滤重复的消息
+func WithMessageDeduplicator(dedup *MessageDeduplicator) BotPreparer {
+	return BotPreparerFunc(func(b *Bot) { b.deduplicator = dedup })
+}
@@ -0,0 +1,50 @@
+package openwechat
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMessageDeduplicator(t *testing.T) {
+	dedup := NewMessageDeduplicator(2, time.Hour)
+	if dedup.Duplicate(&Message{NewMsgId: 1}) || !dedup.Duplicate(&Message{NewMsgId: 1, MsgId: "other"}) {
+		t.Error("expect duplicate by NewMsgId")
+	}
+	if dedup.Duplicate(&Message{MsgId: "2"}) || !dedup.Duplicate(&Message{MsgId: "2"}) {
+		t.Error("expect duplicate by MsgId")
+	}
+	if dedup.Duplicate(&Message{}) || dedup.Duplicate(&Message{}) {
+		t.Error("message without id should never be duplicate")
+	}
+	// 1 最久没有出现, 超过容量时被淘汰
+	dedup.Seen("3")
+	if dedup.Len() != 2 || dedup.Seen("1") {
+		t.Errorf("expect least recently seen id evicted, got %d ids", dedup.Len())
+	}
+
+	dedup = NewMessageDeduplicator(10, 20*time.Millisecond)
+	dedup.Seen("1")
+	time.Sleep(30 * time.Millisecond)
+	if dedup.Seen("1") {
+		t.Error("expect expired id to be forgotten")
+	}
+}
+
+func TestMessageDeduplicatorStorage(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "msgids.json")
+	dedup := NewMessageDeduplicator(0, 0)
+	dedup.Storage = NewAtomicFileHotReloadStorage(filename, 1)
+	// 存储为空时从空的记录开始
+	dedup.Seen("1")
+	dedup.Seen("2")
+	if err := dedup.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewMessageDeduplicator(1, 0)
+	restored.Storage = NewAtomicFileHotReloadStorage(filename, 1)
+	if restored.Len() != 1 || !restored.Seen("2") || restored.Seen("1") {
+		t.Error("expect most recent id restored within capacity")
+	}
+}
@@ -308,7 +308,8 @@ func defaultMessageErrorHandler(err error) error {
 	if errors.As(err, &ret) {
 		switch ret {
 		case failedLoginCheck, cookieInvalid, failedLoginWarn:
-			return ret
+			// 保留原始的错误, 可以通过 errors.As 获取 *APIError
+			return err
 		}
 	}
 	return nil
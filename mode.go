@@ -2,9 +2,13 @@ package openwechat
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"net/url"
+	"reflect"
+	"sort"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -48,7 +52,7 @@ func (n normalMode) BuildGetLoginInfoRequest(ctx context.Context, path string) (
 }
 
 func (n normalMode) PushLogin(ctx context.Context, client *Client, uin int64) (*http.Response, error) {
-	path, err := url.Parse(client.Domain.BaseHost() + webwxpushloginurl)
+	path, err := url.Parse(client.Domain().BaseHost() + webwxpushloginurl)
 	if err != nil {
 		return nil, err
 	}
@@ -117,3 +121,149 @@ func (n desktopMode) BuildPushLoginRequest(ctx context.Context, host string, uin
 	path.RawQuery = params.Encode()
 	return http.NewRequestWithContext(ctx, http.MethodGet, path.String(), nil)
 }
+
+// ModeRequestDecorator 可以由 Mode 实现, 在每个请求发出之前修改请求, 如设置 User-Agent
+// 它在 HttpHooks 的 BeforeRequest 之后调用, 因此会覆盖 HttpHooks 设置的同名请求头
+type ModeRequestDecorator interface {
+	DecorateRequest(req *http.Request)
+}
+
+// ModeConfig 自定义模式的配置
+type ModeConfig struct {
+	// Desktop 为 true 时使用桌面版的登录地址, 即在登录跳转地址和免扫码登录的请求中携带 mod=desktop
+	Desktop bool
+
+	// ClientVersion 获取登录信息时携带的 client-version 请求头, 为空时不携带
+	ClientVersion string
+
+	// Extspam 获取登录信息时携带的 extspam 请求头, 为空时不携带
+	Extspam string
+
+	// UserAgent 所有请求使用的 User-Agent, 为空时使用 HttpHooks 设置的值
+	UserAgent string
+
+	// Header 所有请求都会携带的请求头
+	Header http.Header
+}
+
+// DesktopModeConfig 返回内置的桌面模式使用的配置, 可以在此基础上修改
+//
+//	config := openwechat.DesktopModeConfig()
+//	config.ClientVersion = "2.0.1"
+//	bot := openwechat.DefaultBot(openwechat.WithMode(openwechat.NewMode(config)))
+func DesktopModeConfig() ModeConfig {
+	return ModeConfig{
+		Desktop:       true,
+		ClientVersion: uosPatchClientVersion,
+		Extspam:       uosPatchExtspam,
+	}
+}
+
+type configMode struct {
+	config ModeConfig
+}
+
+// NewMode 根据配置创建一个 Mode
+func NewMode(config ModeConfig) Mode {
+	config.Header = config.Header.Clone()
+	return &configMode{config: config}
+}
+
+func (c *configMode) loginMode() Mode {
+	if c.config.Desktop {
+		return desktop
+	}
+	return normal
+}
+
+func (c *configMode) BuildGetLoginUUIDRequest(ctx context.Context) (*http.Request, error) {
+	return c.loginMode().BuildGetLoginUUIDRequest(ctx)
+}
+
+func (c *configMode) BuildGetLoginInfoRequest(ctx context.Context, path string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.config.ClientVersion != "" {
+		req.Header.Add("client-version", c.config.ClientVersion)
+	}
+	if c.config.Extspam != "" {
+		req.Header.Add("extspam", c.config.Extspam)
+	}
+	return req, nil
+}
+
+func (c *configMode) BuildPushLoginRequest(ctx context.Context, host string, uin int64) (*http.Request, error) {
+	return c.loginMode().BuildPushLoginRequest(ctx, host, uin)
+}
+
+// DecorateRequest 实现了 ModeRequestDecorator 接口
+func (c *configMode) DecorateRequest(req *http.Request) {
+	for key, values := range c.config.Header {
+		req.Header[key] = append([]string(nil), values...)
+	}
+	if c.config.UserAgent != "" {
+		req.Header.Set("User-Agent", c.config.UserAgent)
+	}
+}
+
+// modeRegistry 记录了所有注册过的模式, 可以通过名称选择
+var modeRegistry = struct {
+	sync.RWMutex
+	modes map[string]Mode
+}{modes: map[string]Mode{"normal": normal, "desktop": desktop}}
+
+// RegisterMode 以 name 注册一个模式, 同名的模式会被覆盖
+// 内置的模式为 normal 和 desktop
+func RegisterMode(name string, mode Mode) {
+	if mode == nil {
+		panic("mode is nil")
+	}
+	modeRegistry.Lock()
+	defer modeRegistry.Unlock()
+	modeRegistry.modes[name] = mode
+}
+
+// LookupMode 返回以 name 注册的模式
+func LookupMode(name string) (Mode, bool) {
+	modeRegistry.RLock()
+	defer modeRegistry.RUnlock()
+	mode, exist := modeRegistry.modes[name]
+	return mode, exist
+}
+
+// modeName 返回模式注册的名称, 没有注册时返回类型名称
+// 同一个模式注册了多个名称时返回字典序最小的名称
+func modeName(mode Mode) string {
+	modeRegistry.RLock()
+	defer modeRegistry.RUnlock()
+	// 内置模式优先, 避免被同一个值的其他名称覆盖
+	switch mode {
+	case normal:
+		return "normal"
+	case desktop:
+		return "desktop"
+	}
+	var names []string
+	for name, m := range modeRegistry.modes {
+		if sameMode(m, mode) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Sprintf("%T", mode)
+	}
+	sort.Strings(names)
+	return names[0]
+}
+
+// sameMode 判断两个模式是否相同
+// 动态类型不可比较时直接使用 == 会 panic, 这种模式只能通过 WithModeName 记录名称
+func sameMode(a, b Mode) bool {
+	typ := reflect.TypeOf(a)
+	if typ == nil || typ != reflect.TypeOf(b) || !typ.Comparable() {
+		return false
+	}
+	return a == b
+}
@@ -0,0 +1,42 @@
+package openwechat
+
+import (
+	"context"
+	"testing"
+)
+
+func TestModeName(t *testing.T) {
+	mode := NewMode(DesktopModeConfig())
+	RegisterMode("mode-test-b", mode)
+	RegisterMode("mode-test-a", mode)
+	RegisterMode("mode-test-c", mode)
+	for i := 0; i < 20; i++ {
+		if name := modeName(mode); name != "mode-test-a" {
+			t.Fatalf("expect the smallest name, got %s", name)
+		}
+	}
+	if name := modeName(normal); name != "normal" {
+		t.Errorf("expect normal, got %s", name)
+	}
+}
+
+// uncomparableMode 包含切片, 不能使用 == 比较
+type uncomparableMode struct {
+	normalMode
+	headers []string
+}
+
+func TestModeNameUncomparable(t *testing.T) {
+	RegisterMode("mode-test-uncomparable", uncomparableMode{headers: []string{"a"}})
+	if name := modeName(uncomparableMode{}); name != "openwechat.uncomparableMode" {
+		t.Errorf("expect type name, got %s", name)
+	}
+	bot := NewBot(context.Background())
+	WithModeName("mode-test-uncomparable").Prepare(bot)
+	if name := bot.Caller.Client.modeName; name != "mode-test-uncomparable" {
+		t.Errorf("expect registered name, got %s", name)
+	}
+	if _, err := newHotReloadEnvelope(bot, HotReloadStorageItem{}); err != nil {
+		t.Error(err)
+	}
+}
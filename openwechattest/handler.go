@@ -0,0 +1,536 @@
+package openwechattest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eatmoreapple/openwechat"
+)
+
+const cgi = "/cgi-bin/mmwebwx-bin/"
+
+// placeholderImage 头像、二维码和图片消息接口返回的占位图片
+var placeholderImage = func() []byte {
+	var buffer bytes.Buffer
+	_ = png.Encode(&buffer, image.NewGray(image.Rect(0, 0, 1, 1)))
+	return buffer.Bytes()
+}()
+
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jslogin", s.handleJSLogin)
+	mux.HandleFunc("/qrcode/", s.handleFile(placeholderImage))
+	mux.HandleFunc(cgi+"login", s.handleCheckLogin)
+	mux.HandleFunc(cgi+"webwxnewloginpage", s.handleNewLoginPage)
+	mux.HandleFunc(cgi+"webwxinit", s.handleWebInit)
+	mux.HandleFunc(cgi+"webwxstatusnotify", s.handleOK)
+	mux.HandleFunc(cgi+"synccheck", s.handleSyncCheck)
+	mux.HandleFunc(cgi+"webwxsync", s.handleWebWxSync)
+	mux.HandleFunc(cgi+"webwxsendmsg", s.handleSendMessage)
+	mux.HandleFunc(cgi+"webwxsendemoticon", s.handleSendMessage)
+	mux.HandleFunc(cgi+"webwxsendmsgimg", s.handleSendMessage)
+	mux.HandleFunc(cgi+"webwxsendappmsg", s.handleSendMessage)
+	mux.HandleFunc(cgi+"webwxsendvideomsg", s.handleSendMessage)
+	mux.HandleFunc(cgi+"webwxgetcontact", s.handleGetContact)
+	mux.HandleFunc(cgi+"webwxbatchgetcontact", s.handleBatchGetContact)
+	mux.HandleFunc(cgi+"webwxoplog", s.handleOplog)
+	mux.HandleFunc(cgi+"webwxverifyuser", s.handleOK)
+	mux.HandleFunc(cgi+"webwxrevokemsg", s.handleOK)
+	mux.HandleFunc(cgi+"webwxcheckupload", s.handleCheckUpload)
+	mux.HandleFunc(cgi+"webwxuploadmedia", s.handleUploadMedia)
+	mux.HandleFunc(cgi+"webwxupdatechatroom", s.handleUpdateChatRoom)
+	mux.HandleFunc(cgi+"webwxcreatechatroom", s.handleCreateChatRoom)
+	mux.HandleFunc(cgi+"webwxlogout", s.handleLogout)
+	mux.HandleFunc(cgi+"webwxpushloginurl", s.handlePushLogin)
+	mux.HandleFunc(cgi+"webwxgeticon", s.handleFile(placeholderImage))
+	mux.HandleFunc(cgi+"webwxgetmsgimg", s.handleFile(placeholderImage))
+	mux.HandleFunc(cgi+"webwxgetvoice", s.handleFile([]byte("openwechattest voice")))
+	mux.HandleFunc(cgi+"webwxgetvideo", s.handleFile([]byte("openwechattest video")))
+	mux.HandleFunc(cgi+"webwxgetmedia", s.handleFile([]byte("openwechattest media")))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		endpoint := path.Base(r.URL.Path)
+		if strings.HasPrefix(r.URL.Path, "/qrcode/") {
+			endpoint = "qrcode"
+		}
+		s.mu.Lock()
+		s.calls[endpoint]++
+		var failed *failure
+		if failures := s.failures[endpoint]; len(failures) > 0 {
+			failed, s.failures[endpoint] = &failures[0], failures[1:]
+		}
+		s.mu.Unlock()
+		switch {
+		case failed == nil:
+			mux.ServeHTTP(w, r)
+		case failed.status != 0:
+			w.WriteHeader(failed.status)
+		default:
+			writeJSON(w, baseResponse(failed.ret))
+		}
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func baseResponse(ret openwechat.Ret) map[string]interface{} {
+	return map[string]interface{}{"BaseResponse": openwechat.BaseResponse{Ret: ret}}
+}
+
+// invalidSession 会话失效时返回的错误码
+const invalidSession openwechat.Ret = 1101
+
+// authorized 判断请求是否携带了当前有效的会话信息, 调用时必须持有锁
+func (s *Server) authorized(request *openwechat.BaseRequest) bool {
+	return request != nil && s.session != nil && request.Sid == s.session.sid && request.Skey == s.session.skey
+}
+
+// cookieAuthorized 判断请求是否携带了当前会话的 wxsid 和 wxuin cookie, 调用时必须持有锁
+// 和微信一样, 切换域名之后没有带上 cookie 的同步检查会被拒绝
+func (s *Server) cookieAuthorized(r *http.Request) bool {
+	if s.session == nil {
+		return false
+	}
+	sid, err := r.Cookie("wxsid")
+	if err != nil || sid.Value != s.session.sid {
+		return false
+	}
+	uin, err := r.Cookie("wxuin")
+	return err == nil && uin.Value == strconv.FormatInt(s.self.Uin, 10)
+}
+
+func (s *Server) currentSyncKey() *openwechat.SyncKey {
+	return &openwechat.SyncKey{Count: 1, List: []struct{ Key, Val int64 }{{Key: 1, Val: s.syncKey}}}
+}
+
+func (s *Server) handleFile(data []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		_, _ = w.Write(data)
+	}
+}
+
+func (s *Server) handleOK(w http.ResponseWriter, r *http.Request) {
+	var body struct{ BaseRequest *openwechat.BaseRequest }
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.authorized(body.BaseRequest) {
+		writeJSON(w, baseResponse(invalidSession))
+		return
+	}
+	writeJSON(w, openwechat.MessageResponse{MsgID: s.id()})
+}
+
+func (s *Server) handleJSLogin(w http.ResponseWriter, _ *http.Request) {
+	s.mu.Lock()
+	uuid := s.newUUID()
+	s.mu.Unlock()
+	_, _ = fmt.Fprintf(w, `window.QRLogin.code = 200; window.QRLogin.uuid = "%s";`, uuid)
+}
+
+func (s *Server) handleCheckLogin(w http.ResponseWriter, r *http.Request) {
+	uuid := r.URL.Query().Get("uuid")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, exist := s.logins[uuid]
+	if exist && (state.code == openwechat.LoginCodeWait || state.code == openwechat.LoginCodeScanned && state.scanReported) {
+		s.wait(r.Context(), s.PollTimeout)
+		state, exist = s.logins[uuid]
+	}
+	if !exist {
+		_, _ = fmt.Fprint(w, "window.code=400;")
+		return
+	}
+	code := state.code
+	if state.scanned && !state.scanReported && code == openwechat.LoginCodeSuccess {
+		code = openwechat.LoginCodeScanned
+	}
+	switch code {
+	case openwechat.LoginCodeSuccess:
+		ticket := "ticket-" + s.id()
+		s.tickets[ticket] = uuid
+		delete(s.logins, uuid)
+		redirect := fmt.Sprintf("%s%swebwxnewloginpage?ticket=%s&uuid=%s&lang=zh_CN&scan=%d",
+			s.Domain.BaseHost(), cgi, ticket, uuid, time.Now().Unix())
+		_, _ = fmt.Fprintf(w, "window.code=200;\nwindow.redirect_uri=\"%s\";", redirect)
+	case openwechat.LoginCodeScanned:
+		if state.scanReported {
+			_, _ = fmt.Fprint(w, "window.code=408;")
+			return
+		}
+		state.scanReported = true
+		avatar := base64.StdEncoding.EncodeToString(placeholderImage)
+		_, _ = fmt.Fprintf(w, "window.code=201;window.userAvatar = 'data:img/jpg;base64,%s';", avatar)
+	case openwechat.LoginCodeTimeout:
+		delete(s.logins, uuid)
+		_, _ = fmt.Fprint(w, "window.code=400;")
+	default:
+		_, _ = fmt.Fprint(w, "window.code=408;")
+	}
+}
+
+func (s *Server) handleNewLoginPage(w http.ResponseWriter, r *http.Request) {
+	type loginInfo struct {
+		XMLName xml.Name `xml:"error"`
+		openwechat.LoginInfo
+	}
+	ticket := r.URL.Query().Get("ticket")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exist := s.tickets[ticket]; !exist {
+		info := loginInfo{LoginInfo: openwechat.LoginInfo{Ret: -14, Message: "ticket error"}}
+		_ = xml.NewEncoder(w).Encode(info)
+		return
+	}
+	delete(s.tickets, ticket)
+	if s.requireDesktop && r.Header.Get("extspam") == "" {
+		info := loginInfo{LoginInfo: openwechat.LoginInfo{Ret: 1203, Message: "当前登录环境异常。为了你的帐号安全，暂时不能登录web微信。"}}
+		_ = xml.NewEncoder(w).Encode(info)
+		return
+	}
+	id := s.id()
+	s.session = &session{
+		sid:        "sid-" + id,
+		skey:       "@crypt_skey-" + id,
+		passTicket: "pass-ticket-" + id,
+		dataTicket: "data-ticket-" + id,
+	}
+	s.loggedOnce = true
+	s.syncRet = 0
+	s.syncKey++
+	s.pendingMessages, s.pendingModContacts, s.pendingDelContacts, s.pendingModRooms = nil, nil, nil, nil
+
+	expires := time.Now().Add(12 * time.Hour)
+	cookies := map[string]string{
+		"wxuin":             strconv.FormatInt(s.self.Uin, 10),
+		"wxsid":             s.session.sid,
+		"webwx_data_ticket": s.session.dataTicket,
+		"webwx_auth_ticket": "auth-ticket-" + id,
+		"mm_lang":           "zh_CN",
+	}
+	for name, value := range cookies {
+		http.SetCookie(w, &http.Cookie{Name: name, Value: value, Domain: string(s.Domain), Path: "/", Expires: expires})
+	}
+	info := loginInfo{LoginInfo: openwechat.LoginInfo{
+		WxUin:       s.self.Uin,
+		IsGrayScale: 1,
+		SKey:        s.session.skey,
+		WxSid:       s.session.sid,
+		PassTicket:  s.session.passTicket,
+	}}
+	_ = xml.NewEncoder(w).Encode(info)
+	s.notify()
+}
+
+func (s *Server) handleWebInit(w http.ResponseWriter, r *http.Request) {
+	var body struct{ BaseRequest *openwechat.BaseRequest }
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.authorized(body.BaseRequest) {
+		writeJSON(w, baseResponse(invalidSession))
+		return
+	}
+	writeJSON(w, openwechat.WebInitResponse{
+		Count:       len(s.contacts),
+		SKey:        s.session.skey,
+		SystemTime:  time.Now().Unix(),
+		SyncKey:     s.currentSyncKey(),
+		User:        s.self,
+		ContactList: s.contacts,
+	})
+}
+
+// selector 根据待推送的事件计算 synccheck 的 selector, 调用时必须持有锁
+func (s *Server) selector() openwechat.Selector {
+	switch {
+	case len(s.pendingMessages) > 0:
+		return openwechat.SelectorNewMsg
+	case len(s.pendingDelContacts) > 0:
+		return openwechat.SelectorAddOrDelContact
+	case len(s.pendingModRooms) > 0:
+		return openwechat.SelectorModChatRoom
+	case len(s.pendingModContacts) > 0:
+		return openwechat.SelectorModContact
+	default:
+		return openwechat.SelectorNormal
+	}
+}
+
+func (s *Server) handleSyncCheck(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	request := &openwechat.BaseRequest{Sid: query.Get("sid"), Skey: query.Get("skey")}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	authorized := func() bool { return s.authorized(request) && s.cookieAuthorized(r) }
+	if authorized() && s.selector() == openwechat.SelectorNormal {
+		s.wait(r.Context(), s.PollTimeout)
+	}
+	if r.Context().Err() != nil {
+		return
+	}
+	if !authorized() {
+		ret := s.syncRet
+		if ret == 0 {
+			ret = invalidSession
+		}
+		_, _ = fmt.Fprintf(w, `window.synccheck={retcode:"%d",selector:"0"}`, ret)
+		return
+	}
+	_, _ = fmt.Fprintf(w, `window.synccheck={retcode:"0",selector:"%s"}`, s.selector())
+}
+
+func (s *Server) handleWebWxSync(w http.ResponseWriter, r *http.Request) {
+	var body struct{ BaseRequest *openwechat.BaseRequest }
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.authorized(body.BaseRequest) {
+		writeJSON(w, baseResponse(invalidSession))
+		return
+	}
+	s.syncKey++
+	messages, remaining := s.pendingMessages, []*openwechat.Message(nil)
+	if s.SyncBatchSize > 0 && len(messages) > s.SyncBatchSize {
+		messages, remaining = messages[:s.SyncBatchSize], messages[s.SyncBatchSize:]
+	}
+	continueFlag := 0
+	if len(remaining) > 0 {
+		continueFlag = 1
+	}
+	writeJSON(w, map[string]interface{}{
+		"BaseResponse":           openwechat.BaseResponse{},
+		"AddMsgCount":            len(messages),
+		"AddMsgList":             messages,
+		"ModContactCount":        len(s.pendingModContacts),
+		"ModContactList":         s.pendingModContacts,
+		"DelContactCount":        len(s.pendingDelContacts),
+		"DelContactList":         s.pendingDelContacts,
+		"ModChatRoomMemberCount": len(s.pendingModRooms),
+		"ModChatRoomMemberList":  s.pendingModRooms,
+		"ContinueFlag":           continueFlag,
+		"SyncKey":                s.currentSyncKey(),
+		"SyncCheckKey":           s.currentSyncKey(),
+		"Skey":                   s.session.skey,
+	})
+	s.pendingMessages, s.pendingModContacts, s.pendingDelContacts, s.pendingModRooms = remaining, nil, nil, nil
+}
+
+func (s *Server) handleSendMessage(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		BaseRequest *openwechat.BaseRequest
+		Msg         openwechat.SendMessage
+	}
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.authorized(body.BaseRequest) {
+		writeJSON(w, baseResponse(invalidSession))
+		return
+	}
+	sent := Sent{Endpoint: path.Base(r.URL.Path), MsgID: s.id(), Message: body.Msg}
+	s.sent = append(s.sent, sent)
+	s.notify()
+	writeJSON(w, openwechat.MessageResponse{MsgID: sent.MsgID, LocalID: body.Msg.LocalID})
+}
+
+func (s *Server) handleGetContact(w http.ResponseWriter, r *http.Request) {
+	skey := r.URL.Query().Get("skey")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.session == nil || s.session.skey != skey {
+		writeJSON(w, baseResponse(invalidSession))
+		return
+	}
+	writeJSON(w, openwechat.WebWxContactResponse{MemberCount: len(s.contacts), MemberList: s.contacts})
+}
+
+func (s *Server) handleBatchGetContact(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		BaseRequest *openwechat.BaseRequest
+		List        openwechat.UserDetailItemList
+	}
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.authorized(body.BaseRequest) {
+		writeJSON(w, baseResponse(invalidSession))
+		return
+	}
+	// 返回的联系人需要跟请求的顺序一一对应
+	contacts := make([]*openwechat.User, len(body.List))
+	for index, item := range body.List {
+		if contact := s.contact(item.UserName); contact != nil {
+			contacts[index] = contact
+		} else {
+			contacts[index] = &openwechat.User{UserName: item.UserName}
+		}
+	}
+	writeJSON(w, openwechat.WebWxBatchContactResponse{Count: len(contacts), ContactList: contacts})
+}
+
+func (s *Server) handleOplog(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		BaseRequest *openwechat.BaseRequest
+		CmdId       int
+		RemarkName  string
+		UserName    string
+	}
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.authorized(body.BaseRequest) {
+		writeJSON(w, baseResponse(invalidSession))
+		return
+	}
+	if contact := s.contact(body.UserName); contact != nil && body.CmdId == 2 {
+		contact.RemarkName = body.RemarkName
+	}
+	writeJSON(w, baseResponse(0))
+}
+
+func (s *Server) handleCheckUpload(w http.ResponseWriter, r *http.Request) {
+	var body struct{ BaseRequest *openwechat.BaseRequest }
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.authorized(body.BaseRequest) {
+		writeJSON(w, baseResponse(invalidSession))
+		return
+	}
+	id := s.id()
+	writeJSON(w, map[string]interface{}{
+		"BaseResponse": openwechat.BaseResponse{},
+		"AESKey":       "aes-key-" + id,
+		"Signature":    "signature-" + id,
+	})
+}
+
+func (s *Server) handleUploadMedia(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var request struct{ BaseRequest *openwechat.BaseRequest }
+	_ = json.Unmarshal([]byte(r.FormValue("uploadmediarequest")), &request)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.authorized(request.BaseRequest) || r.FormValue("webwx_data_ticket") != s.session.dataTicket {
+		writeJSON(w, baseResponse(invalidSession))
+		return
+	}
+	mediaID := "@crypt_media-" + s.id()
+	chunks, _ := strconv.Atoi(r.FormValue("chunks"))
+	chunk, _ := strconv.Atoi(r.FormValue("chunk"))
+	// 分块上传时只记录最后一块
+	if chunks <= 1 || chunk == chunks-1 {
+		size, _ := strconv.ParseInt(r.FormValue("size"), 10, 64)
+		s.uploads = append(s.uploads, Upload{Filename: r.FormValue("name"), MediaID: mediaID, Size: size})
+		s.notify()
+	}
+	writeJSON(w, openwechat.UploadResponse{MediaId: mediaID})
+}
+
+func (s *Server) handleUpdateChatRoom(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		BaseRequest      *openwechat.BaseRequest
+		ChatRoomName     string
+		NewTopic         string
+		AddMemberList    string
+		InviteMemberList string
+		DelMemberList    string
+	}
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.authorized(body.BaseRequest) {
+		writeJSON(w, baseResponse(invalidSession))
+		return
+	}
+	group := s.contact(body.ChatRoomName)
+	if group == nil {
+		writeJSON(w, baseResponse(1))
+		return
+	}
+	switch r.URL.Query().Get("fun") {
+	case "modtopic":
+		group.NickName = body.NewTopic
+	case "addmember", "invitemember":
+		for _, username := range strings.Split(body.AddMemberList+body.InviteMemberList, ",") {
+			if member := s.contact(username); member != nil {
+				group.MemberList = append(group.MemberList, member)
+			}
+		}
+	case "delmember":
+		for _, username := range strings.Split(body.DelMemberList, ",") {
+			for index, member := range group.MemberList {
+				if member.UserName == username {
+					group.MemberList = append(group.MemberList[:index], group.MemberList[index+1:]...)
+					break
+				}
+			}
+		}
+	}
+	group.MemberCount = len(group.MemberList)
+	writeJSON(w, baseResponse(0))
+}
+
+func (s *Server) handleCreateChatRoom(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		BaseRequest *openwechat.BaseRequest
+		MemberList  []struct{ UserName string }
+		Topic       string
+	}
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.authorized(body.BaseRequest) {
+		writeJSON(w, baseResponse(invalidSession))
+		return
+	}
+	group := &openwechat.User{UserName: "@@chatroom-" + s.id(), NickName: body.Topic, MemberList: openwechat.Members{s.self}}
+	for _, item := range body.MemberList {
+		if member := s.contact(item.UserName); member != nil {
+			group.MemberList = append(group.MemberList, member)
+		}
+	}
+	group.MemberCount = len(group.MemberList)
+	s.contacts = append(s.contacts, group)
+	writeJSON(w, map[string]interface{}{"BaseResponse": openwechat.BaseResponse{}, "ChatRoomName": group.UserName})
+}
+
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	skey := r.URL.Query().Get("skey")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.session != nil && s.session.skey == skey {
+		s.session = nil
+		s.syncRet = invalidSession
+		s.notify()
+	}
+	writeJSON(w, baseResponse(0))
+}
+
+func (s *Server) handlePushLogin(w http.ResponseWriter, r *http.Request) {
+	uin := r.URL.Query().Get("uin")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.loggedOnce || uin != strconv.FormatInt(s.self.Uin, 10) {
+		writeJSON(w, openwechat.PushLoginResponse{Ret: "1", Msg: "push login failed"})
+		return
+	}
+	writeJSON(w, openwechat.PushLoginResponse{Ret: "0", Msg: "all ok", UUID: s.newUUID()})
+}
@@ -0,0 +1,476 @@
+// Package openwechattest 提供一个进程内的微信网页版模拟服务端,
+// 用于在没有真实微信账号和手机扫码的情况下测试 Bot 的逻辑。
+//
+//	server := openwechattest.NewServer()
+//	defer server.Close()
+//
+//	bot := openwechat.NewBot(context.Background())
+//	server.Install(bot.Caller.Client)
+//	bot.UUIDCallback = func(uuid string) { _ = server.ScanAndConfirm(uuid) }
+//	if err := bot.Login(); err != nil {
+//		// ...
+//	}
+//	server.ReceiveText("@friend", "ping")
+package openwechattest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/eatmoreapple/openwechat"
+)
+
+// ErrUnknownUUID 二维码不存在或者已经被使用
+var ErrUnknownUUID = errors.New("openwechattest: unknown uuid")
+
+// Sent 记录 bot 通过发送接口发出的一条消息
+type Sent struct {
+	// Endpoint 发送消息使用的接口, 如 webwxsendmsg、webwxsendmsgimg
+	Endpoint string
+	MsgID    string
+	Message  openwechat.SendMessage
+}
+
+// Upload 记录 bot 上传的一个文件
+type Upload struct {
+	Filename string
+	MediaID  string
+	Size     int64
+}
+
+// failure 一次预先设置的接口失败
+type failure struct {
+	status int
+	ret    openwechat.Ret
+}
+
+type loginState struct {
+	code openwechat.LoginCode
+	// scanned 手机是否扫过码, 扫码状态至少会被 login 接口返回一次
+	scanned      bool
+	scanReported bool
+}
+
+type session struct {
+	sid        string
+	skey       string
+	passTicket string
+	dataTicket string
+}
+
+// Server 微信网页版模拟服务端
+// 它实现了 url.go 里面定义的接口, 并通过 Transport 将 Client 的所有请求转发到自身
+type Server struct {
+	*httptest.Server
+
+	// Domain 登录成功后重定向的微信域名, 默认为 wx.qq.com
+	Domain openwechat.WechatDomain
+
+	// PollTimeout 长轮询接口(login、synccheck)在没有新事件时的最长等待时间
+	// 需要在 bot 发起请求之前设置
+	PollTimeout time.Duration
+
+	// SyncBatchSize webwxsync 每次最多返回的消息数量, 还有剩余的消息时 ContinueFlag 为 1, 为零时不限制
+	SyncBatchSize int
+
+	mu             sync.Mutex
+	autoConfirm    bool
+	requireDesktop bool
+	blockedHosts   map[string]bool
+	failures       map[string][]failure
+	changed        chan struct{}
+	nextID         int64
+	self           *openwechat.User
+	contacts       []*openwechat.User
+	logins         map[string]*loginState
+	tickets        map[string]string
+	lastUUID       string
+	session        *session
+	// loggedOnce 是否有过登录成功的会话, 用于判断是否允许免扫码登录
+	loggedOnce bool
+	syncRet    openwechat.Ret
+	syncKey    int64
+	calls      map[string]int
+
+	pendingMessages    []*openwechat.Message
+	pendingModContacts []*openwechat.User
+	pendingDelContacts []*openwechat.User
+	pendingModRooms    []*openwechat.User
+
+	sent    []Sent
+	uploads []Upload
+}
+
+// NewServer 创建并启动一个模拟服务端, 使用完毕后需要调用 Close
+func NewServer() *Server {
+	s := &Server{
+		Domain:       "wx.qq.com",
+		PollTimeout:  time.Second,
+		changed:      make(chan struct{}),
+		logins:       make(map[string]*loginState),
+		tickets:      make(map[string]string),
+		calls:        make(map[string]int),
+		blockedHosts: make(map[string]bool),
+		failures:     make(map[string][]failure),
+		self: &openwechat.User{
+			Uin:      10001,
+			UserName: "@openwechattest",
+			NickName: "openwechattest",
+		},
+	}
+	s.Server = httptest.NewServer(s.handler())
+	return s
+}
+
+// Transport 返回一个 http.RoundTripper, 它会把任意域名的请求转发到当前的模拟服务端
+// 请求的原始域名会保留在 Host 中
+func (s *Server) Transport() http.RoundTripper {
+	target, _ := url.Parse(s.URL)
+	return &transport{target: target, base: s.Server.Client().Transport, server: s}
+}
+
+// Install 将 Client 的请求全部转发到当前的模拟服务端
+// Bot 的 Login、HotLogin、PushLogin 等方法不需要做任何修改
+func (s *Server) Install(client *openwechat.Client) {
+	client.HTTPClient().Transport = s.Transport()
+}
+
+// NewBot 创建一个已经连接到当前模拟服务端的 Bot
+func (s *Server) NewBot(prepares ...openwechat.BotPreparer) *openwechat.Bot {
+	bot := openwechat.NewBot(context.Background())
+	for _, prepare := range prepares {
+		prepare.Prepare(bot)
+	}
+	s.Install(bot.Caller.Client)
+	return bot
+}
+
+type transport struct {
+	target *url.URL
+	base   http.RoundTripper
+	server *Server
+}
+
+// RoundTrip 实现了 http.RoundTripper 接口
+// 这里必须复制一份请求, 否则 http.Client 在写入 cookie 的时候会拿到被修改过的 URL
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.server.hostBlocked(req.URL.Hostname()) {
+		return nil, fmt.Errorf("openwechattest: dial %s: connection refused", req.URL.Host)
+	}
+	r := req.Clone(req.Context())
+	r.URL.Scheme = t.target.Scheme
+	r.URL.Host = t.target.Host
+	r.Host = req.URL.Host
+	return t.base.RoundTrip(r)
+}
+
+// Self 返回模拟的登录用户, 登录之前可以直接修改它的字段
+func (s *Server) Self() *openwechat.User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.self
+}
+
+// notify 唤醒所有等待状态变更的长轮询, 调用时必须持有锁
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// wait 等待状态变更或者超时, 调用时必须持有锁, 返回时依然持有锁
+func (s *Server) wait(ctx context.Context, timeout time.Duration) {
+	changed := s.changed
+	s.mu.Unlock()
+	defer s.mu.Lock()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-changed:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+func (s *Server) id() string {
+	s.nextID++
+	return strconv.FormatInt(s.nextID, 10)
+}
+
+func (s *Server) newUUID() string {
+	uuid := "uuid-" + s.id()
+	s.logins[uuid] = &loginState{code: openwechat.LoginCodeWait}
+	s.lastUUID = uuid
+	if s.autoConfirm {
+		s.logins[uuid].code = openwechat.LoginCodeSuccess
+	}
+	s.notify()
+	return uuid
+}
+
+func (s *Server) setLoginCode(uuid string, code openwechat.LoginCode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, exist := s.logins[uuid]
+	if !exist {
+		return ErrUnknownUUID
+	}
+	state.code = code
+	s.notify()
+	return nil
+}
+
+// SetAutoConfirm 设置为 true 时, 新生成的二维码(包括免扫码登录的请求)会被立即确认登录
+func (s *Server) SetAutoConfirm(autoConfirm bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.autoConfirm = autoConfirm
+}
+
+// SetRequireDesktop 设置为 true 时, 没有使用桌面模式的登录请求会返回登录环境异常(1203)
+func (s *Server) SetRequireDesktop(requireDesktop bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requireDesktop = requireDesktop
+}
+
+// BlockHost 模拟无法连接到指定的域名, 如 webpush.wx.qq.com, blocked 为 false 时恢复连接
+func (s *Server) BlockHost(host string, blocked bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blockedHosts[host] = blocked
+}
+
+// Fail 让接下来 times 次对 endpoint 的请求失败, endpoint 为接口路径的最后一段, 如 webwxinit
+// status 不为零时返回该 HTTP 状态码, 否则返回错误码为 ret 的 BaseResponse
+func (s *Server) Fail(endpoint string, times int, status int, ret openwechat.Ret) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < times; i++ {
+		s.failures[endpoint] = append(s.failures[endpoint], failure{status: status, ret: ret})
+	}
+}
+
+func (s *Server) hostBlocked(host string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.blockedHosts[host]
+}
+
+// LatestUUID 返回最近一次生成的二维码 uuid
+func (s *Server) LatestUUID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastUUID
+}
+
+// Scan 模拟手机扫描了二维码, 但还没有确认登录
+func (s *Server) Scan(uuid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, exist := s.logins[uuid]
+	if !exist {
+		return ErrUnknownUUID
+	}
+	state.code = openwechat.LoginCodeScanned
+	state.scanned = true
+	s.notify()
+	return nil
+}
+
+// Confirm 模拟手机确认登录
+func (s *Server) Confirm(uuid string) error {
+	return s.setLoginCode(uuid, openwechat.LoginCodeSuccess)
+}
+
+// ScanAndConfirm 模拟手机扫码并确认登录
+func (s *Server) ScanAndConfirm(uuid string) error {
+	if err := s.Scan(uuid); err != nil {
+		return err
+	}
+	return s.Confirm(uuid)
+}
+
+// Expire 让二维码过期
+func (s *Server) Expire(uuid string) error {
+	return s.setLoginCode(uuid, openwechat.LoginCodeTimeout)
+}
+
+// LoggedIn 判断当前是否有已登录的会话
+func (s *Server) LoggedIn() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.session != nil
+}
+
+// Logout 模拟用户在手机上退出登录, 之后 synccheck 会返回 1101
+func (s *Server) Logout() {
+	s.Kick(openwechat.Ret(1101))
+}
+
+// Kick 让当前会话失效, 之后 synccheck 会返回指定的 retcode
+func (s *Server) Kick(ret openwechat.Ret) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session = nil
+	s.syncRet = ret
+	s.notify()
+}
+
+// AddContact 添加联系人
+// 如果当前有已登录的会话, 联系人的变更会通过 webwxsync 的 ModContactList 推送给 bot
+func (s *Server) AddContact(users ...*openwechat.User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, user := range users {
+		if index := s.contactIndex(user.UserName); index >= 0 {
+			s.contacts[index] = user
+		} else {
+			s.contacts = append(s.contacts, user)
+		}
+		if s.session != nil {
+			s.pendingModContacts = append(s.pendingModContacts, user)
+		}
+	}
+	s.notify()
+}
+
+// ModifyContact 修改联系人信息, 跟 AddContact 的行为一致
+func (s *Server) ModifyContact(users ...*openwechat.User) {
+	s.AddContact(users...)
+}
+
+// DeleteContact 删除联系人, 变更会通过 webwxsync 的 DelContactList 推送给 bot
+func (s *Server) DeleteContact(usernames ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, username := range usernames {
+		if index := s.contactIndex(username); index >= 0 {
+			s.contacts = append(s.contacts[:index], s.contacts[index+1:]...)
+		}
+		if s.session != nil {
+			s.pendingDelContacts = append(s.pendingDelContacts, &openwechat.User{UserName: username})
+		}
+	}
+	s.notify()
+}
+
+// ModifyChatRoomMembers 修改群成员列表, 变更会通过 webwxsync 的 ModChatRoomMemberList 推送给 bot
+func (s *Server) ModifyChatRoomMembers(group *openwechat.User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if index := s.contactIndex(group.UserName); index >= 0 {
+		s.contacts[index] = group
+	} else {
+		s.contacts = append(s.contacts, group)
+	}
+	if s.session != nil {
+		s.pendingModRooms = append(s.pendingModRooms, group)
+	}
+	s.notify()
+}
+
+// Contacts 返回当前所有的联系人
+func (s *Server) Contacts() []*openwechat.User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*openwechat.User(nil), s.contacts...)
+}
+
+func (s *Server) contactIndex(username string) int {
+	for index, user := range s.contacts {
+		if user.UserName == username {
+			return index
+		}
+	}
+	return -1
+}
+
+func (s *Server) contact(username string) *openwechat.User {
+	if username == s.self.UserName {
+		return s.self
+	}
+	if index := s.contactIndex(username); index >= 0 {
+		return s.contacts[index]
+	}
+	return nil
+}
+
+// ReceiveMessage 模拟 bot 收到消息, 多条消息会同时进入待推送的队列, 可以用来模拟积压的消息
+// 如果没有设置 MsgId、NewMsgId、CreateTime 和 ToUserName, 会自动填充
+func (s *Server) ReceiveMessage(msgs ...*openwechat.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, msg := range msgs {
+		if msg.MsgId == "" {
+			msg.MsgId = s.id()
+		}
+		if msg.NewMsgId == 0 {
+			msg.NewMsgId, _ = strconv.ParseInt(msg.MsgId, 10, 64)
+		}
+		if msg.CreateTime == 0 {
+			msg.CreateTime = time.Now().Unix()
+		}
+		if msg.ToUserName == "" {
+			msg.ToUserName = s.self.UserName
+		}
+		s.pendingMessages = append(s.pendingMessages, msg)
+	}
+	s.notify()
+}
+
+// ReceiveText 模拟 bot 收到一条文本消息
+func (s *Server) ReceiveText(from, content string) *openwechat.Message {
+	msg := &openwechat.Message{
+		MsgType:      openwechat.MsgTypeText,
+		FromUserName: from,
+		Content:      content,
+	}
+	s.ReceiveMessage(msg)
+	return msg
+}
+
+// Sent 返回 bot 发出的所有消息
+func (s *Server) Sent() []Sent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Sent(nil), s.sent...)
+}
+
+// WaitSent 阻塞直到 bot 至少发出了 n 条消息, 或者 ctx 结束
+func (s *Server) WaitSent(ctx context.Context, n int) ([]Sent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.sent) < n {
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+			s.mu.Lock()
+		case <-ctx.Done():
+			s.mu.Lock()
+			return append([]Sent(nil), s.sent...), ctx.Err()
+		}
+	}
+	return append([]Sent(nil), s.sent...), nil
+}
+
+// Uploads 返回 bot 上传的所有文件
+func (s *Server) Uploads() []Upload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Upload(nil), s.uploads...)
+}
+
+// Calls 返回指定接口被请求的次数, endpoint 为接口路径的最后一段, 如 webwxinit
+func (s *Server) Calls(endpoint string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[endpoint]
+}
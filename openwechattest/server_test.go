@@ -0,0 +1,1526 @@
+package openwechattest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eatmoreapple/openwechat"
+)
+
+func newTestServer(t *testing.T) *Server {
+	server := NewServer()
+	server.PollTimeout = 100 * time.Millisecond
+	server.AddContact(&openwechat.User{UserName: "@friend", NickName: "friend"})
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newBot 创建一个连接到 server 的 bot, 测试结束时通过取消 context 让它退出
+func newBot(t *testing.T, server *Server, prepares ...openwechat.BotPreparer) (*openwechat.Bot, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	prepares = append([]openwechat.BotPreparer{openwechat.WithContextOption(ctx)}, prepares...)
+	return server.NewBot(prepares...), cancel
+}
+
+func login(t *testing.T, server *Server, bot *openwechat.Bot) {
+	bot.UUIDCallback = func(uuid string) {
+		if err := server.ScanAndConfirm(uuid); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := bot.Login(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScanLogin(t *testing.T) {
+	server := newTestServer(t)
+	bot, _ := newBot(t, server)
+	var scanned, logged bool
+	bot.ScanCallBack = func(body openwechat.CheckLoginResponse) { scanned = true }
+	bot.LoginCallBack = func(body openwechat.CheckLoginResponse) { logged = true }
+	login(t, server, bot)
+	if !scanned || !logged {
+		t.Errorf("expect scan and login callbacks, got scanned=%v logged=%v", scanned, logged)
+	}
+	self, err := bot.GetCurrentUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if self.UserName != server.Self().UserName {
+		t.Errorf("unexpected self: %s", self.UserName)
+	}
+	friends, err := self.Friends()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if friends.Count() != 1 || friends.First().NickName != "friend" {
+		t.Errorf("unexpected friends: %v", friends)
+	}
+}
+
+func TestQrcodeRefresh(t *testing.T) {
+	server := newTestServer(t)
+	bot, _ := newBot(t, server, openwechat.WithQrcodeRefresh(2, time.Time{}))
+	var uuids, expired []string
+	bot.UUIDCallback = func(uuid string) {
+		uuids = append(uuids, uuid)
+		if len(uuids) <= 2 {
+			_ = server.Expire(uuid)
+		} else {
+			_ = server.ScanAndConfirm(uuid)
+		}
+	}
+	bot.UUIDExpiredCallback = func(uuid string) { expired = append(expired, uuid) }
+	if err := bot.Login(); err != nil {
+		t.Fatal(err)
+	}
+	if len(uuids) != 3 || len(expired) != 2 || expired[1] != uuids[1] || uuids[1] == uuids[2] {
+		t.Errorf("unexpected qrcode refresh, uuids=%v expired=%v", uuids, expired)
+	}
+
+	bot, _ = newBot(t, server, openwechat.WithQrcodeRefresh(1, time.Time{}))
+	bot.UUIDCallback = func(uuid string) { _ = server.Expire(uuid) }
+	if err := bot.Login(); !errors.Is(err, openwechat.ErrLoginTimeout) {
+		t.Errorf("expect ErrLoginTimeout after refresh limit, got %v", err)
+	}
+}
+
+func TestReplyMessage(t *testing.T) {
+	server := newTestServer(t)
+	bot, _ := newBot(t, server)
+	replied := make(chan error, 1)
+	bot.MessageHandler = func(msg *openwechat.Message) {
+		if msg.IsText() && msg.Content == "ping" {
+			_, err := msg.ReplyText("pong")
+			replied <- err
+		}
+	}
+	login(t, server, bot)
+	server.ReceiveText("@friend", "ping")
+
+	select {
+	case err := <-replied:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not handled")
+	}
+	sent := server.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("expect 1 sent message, got %d", len(sent))
+	}
+	if sent[0].Endpoint != "webwxsendmsg" || sent[0].Message.Content != "pong" || sent[0].Message.ToUserName != "@friend" {
+		t.Errorf("unexpected sent message: %+v", sent[0])
+	}
+}
+
+func TestPhoneLogout(t *testing.T) {
+	server := newTestServer(t)
+	bot, _ := newBot(t, server)
+	login(t, server, bot)
+	server.Logout()
+
+	select {
+	case <-bot.Context().Done():
+		var ret openwechat.Ret
+		if err := bot.CrashReason(); !errors.As(err, &ret) || ret != 1101 {
+			t.Errorf("unexpected crash reason: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("bot still alive after logout")
+	}
+}
+
+func TestHotLoginAndPushLogin(t *testing.T) {
+	server := newTestServer(t)
+	filename := filepath.Join(t.TempDir(), "storage.json")
+	storage := func() openwechat.HotReloadStorage {
+		storage := openwechat.NewFileHotReloadStorage(filename)
+		t.Cleanup(func() { _ = storage.Close() })
+		return storage
+	}
+
+	bot, exit := newBot(t, server)
+	login(t, server, bot)
+	if err := bot.DumpTo(storage()); err != nil {
+		t.Fatal(err)
+	}
+	exit()
+
+	hot, exit := newBot(t, server)
+	if err := hot.HotLogin(storage()); err != nil {
+		t.Fatal(err)
+	}
+	exit()
+	if server.Calls("jslogin") != 1 {
+		t.Errorf("hot login should not ask for a new qrcode")
+	}
+
+	server.SetAutoConfirm(true)
+	push, _ := newBot(t, server)
+	if err := push.PushLogin(openwechat.NewFileHotReloadStorage(filepath.Join(t.TempDir(), "storage.json"))); err == nil {
+		t.Error("push login with empty storage should fail")
+	}
+	push, _ = newBot(t, server)
+	if err := push.PushLogin(storage()); err != nil {
+		t.Fatal(err)
+	}
+	if server.Calls("webwxpushloginurl") != 1 {
+		t.Errorf("expect one push login request, got %d", server.Calls("webwxpushloginurl"))
+	}
+}
+
+func TestChainLogin(t *testing.T) {
+	server := newTestServer(t)
+	storage := openwechat.NewFileHotReloadStorage(filepath.Join(t.TempDir(), "storage.json"))
+	t.Cleanup(func() { _ = storage.Close() })
+
+	// 热存储为空时跳过 push 和 hot, 使用扫码登录
+	bot, exit := newBot(t, server)
+	bot.UUIDCallback = func(uuid string) { _ = server.ScanAndConfirm(uuid) }
+	scan := &openwechat.ScanLogin{}
+	chain := openwechat.ChainLogin(openwechat.NewPushLogin(storage), openwechat.NewHotLogin(storage), scan)
+	if err := bot.LoginWith(chain); err != nil {
+		t.Fatal(err)
+	}
+	if chain.Winner() != scan {
+		t.Errorf("expect scan login to win, got %T", chain.Winner())
+	}
+	for _, attempt := range chain.Attempts()[:2] {
+		if !attempt.Skipped {
+			t.Errorf("expect %T to be skipped, got %v", attempt.Login, attempt.Err)
+		}
+	}
+	exit()
+
+	// 手机上没有确认 push 登录, 超时之后使用热登录
+	bot, _ = newBot(t, server)
+	push, hot := openwechat.NewPushLogin(storage), openwechat.NewHotLogin(storage)
+	chain = openwechat.ChainLogin(openwechat.LoginWithTimeout(push, 300*time.Millisecond), hot, scan)
+	if err := bot.LoginWith(chain); err != nil {
+		t.Fatal(err)
+	}
+	if chain.Winner() != hot {
+		t.Errorf("expect hot login to win, got %T", chain.Winner())
+	}
+	if attempts := chain.Attempts(); len(attempts) != 2 || !errors.Is(attempts[0].Err, context.DeadlineExceeded) {
+		t.Errorf("unexpected attempts: %+v", attempts)
+	}
+}
+
+func TestEncryptedHotLogin(t *testing.T) {
+	server := newTestServer(t)
+	filename := filepath.Join(t.TempDir(), "storage.json")
+	ring := openwechat.NewKeyRing("v1", []byte("0123456789abcdef"))
+	storage := func() openwechat.HotReloadStorage {
+		storage := openwechat.NewEncryptedHotReloadStorage(openwechat.NewFileHotReloadStorage(filename), ring)
+		t.Cleanup(func() { _ = storage.Close() })
+		return storage
+	}
+
+	bot, exit := newBot(t, server)
+	bot.UUIDCallback = func(uuid string) { _ = server.ScanAndConfirm(uuid) }
+	if err := bot.HotLogin(storage(), openwechat.NewRetryLoginOption()); err != nil {
+		t.Fatal(err)
+	}
+	exit()
+
+	hot, _ := newBot(t, server)
+	if err := hot.HotLogin(storage()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionRefresher(t *testing.T) {
+	server := newTestServer(t)
+	server.SetAutoConfirm(true)
+	refreshed := make(chan error, 1)
+	refresher := &openwechat.SessionRefresher{
+		// 假服务器的 cookie 12 小时之后过期, 登录之后马上就会刷新
+		Before: 13 * time.Hour,
+		Callback: func(info openwechat.SessionInfo, err error) {
+			select {
+			case refreshed <- err:
+			default:
+			}
+		},
+	}
+	bot, _ := newBot(t, server, openwechat.WithSessionRefresher(refresher))
+	received := make(chan struct{}, 1)
+	bot.MessageHandler = func(msg *openwechat.Message) { received <- struct{}{} }
+	login(t, server, bot)
+
+	info := bot.SessionInfo()
+	if info.LoginTime.IsZero() || !info.HasDataTicket || info.ExpiresAt().IsZero() {
+		t.Errorf("unexpected session info: %+v", info)
+	}
+	select {
+	case err := <-refreshed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not refreshed")
+	}
+	if server.Calls("webwxpushloginurl") != 1 {
+		t.Errorf("expect one push login request, got %d", server.Calls("webwxpushloginurl"))
+	}
+	// 刷新之后消息同步依然在运行
+	server.ReceiveText("@friend", "ping")
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received after refresh")
+	}
+	if bot.SessionInfo().LastSyncTime.IsZero() {
+		t.Error("expect last sync time")
+	}
+}
+
+func TestReconnector(t *testing.T) {
+	server := newTestServer(t)
+	attempts := make(chan error, 2)
+	reconnector := &openwechat.Reconnector{
+		MaxAttempts: 1,
+		Timeout:     300 * time.Millisecond,
+		Backoff:     func(int) time.Duration { return time.Millisecond },
+		OnAttempt:   func(attempt int, err error) { attempts <- err },
+	}
+	bot, _ := newBot(t, server, openwechat.WithReconnector(reconnector))
+	received := make(chan string, 1)
+	bot.MessageHandler = func(msg *openwechat.Message) { received <- msg.Content }
+	login(t, server, bot)
+
+	// cookie 失效之后通过免扫码登录恢复, 消息同步继续运行
+	server.SetAutoConfirm(true)
+	server.Kick(openwechat.Ret(1102))
+	select {
+	case err := <-attempts:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reconnect not attempted")
+	}
+	server.ReceiveText("@friend", "after reconnect")
+	select {
+	case content := <-received:
+		if content != "after reconnect" {
+			t.Errorf("unexpected message: %s", content)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received after reconnect")
+	}
+
+	// 手机上没有确认登录, 放弃重连之后 bot 退出
+	server.SetAutoConfirm(false)
+	server.Kick(openwechat.Ret(1102))
+	select {
+	case <-bot.Context().Done():
+		var ret openwechat.Ret
+		if err := bot.CrashReason(); !errors.As(err, &ret) || ret != 1102 {
+			t.Errorf("unexpected crash reason: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("bot still alive after giving up")
+	}
+	if server.Calls("webwxpushloginurl") != 2 {
+		t.Errorf("expect 2 push login requests, got %d", server.Calls("webwxpushloginurl"))
+	}
+}
+
+func TestReconnectorLoggedInElsewhere(t *testing.T) {
+	server := newTestServer(t)
+	attempts := make(chan error, 1)
+	reconnector := &openwechat.Reconnector{
+		Backoff:   func(int) time.Duration { return time.Millisecond },
+		OnAttempt: func(attempt int, err error) { attempts <- err },
+	}
+	bot, _ := newBot(t, server, openwechat.WithReconnector(reconnector))
+	login(t, server, bot)
+
+	// 在其他地方登录之后不会重连, 否则两边会互相挤下线
+	server.SetAutoConfirm(true)
+	server.Kick(openwechat.Ret(1100))
+	select {
+	case <-bot.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("bot still alive after logged in elsewhere")
+	}
+	select {
+	case err := <-attempts:
+		t.Errorf("unexpected reconnect attempt: %v", err)
+	default:
+	}
+	if calls := server.Calls("webwxpushloginurl"); calls != 0 {
+		t.Errorf("expect no push login request, got %d", calls)
+	}
+}
+
+func TestBotManager(t *testing.T) {
+	servers := map[string]*Server{"alice": newTestServer(t), "bob": newTestServer(t)}
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	manager := openwechat.NewBotManager(ctx)
+	var storageMu sync.Mutex
+	storages := make(map[string][]*closeTracker)
+	manager.Storage = func(key string) openwechat.HotReloadStorage {
+		storage := &closeTracker{ReadWriteCloser: openwechat.NewFileHotReloadStorage(filepath.Join(dir, key+".json"))}
+		storageMu.Lock()
+		storages[key] = append(storages[key], storage)
+		storageMu.Unlock()
+		return storage
+	}
+	closed := func(key string) []bool {
+		storageMu.Lock()
+		defer storageMu.Unlock()
+		var closed []bool
+		for _, storage := range storages[key] {
+			closed = append(closed, storage.closed.Load())
+		}
+		return closed
+	}
+	manager.Prepare = func(key string) []openwechat.BotPreparer {
+		server := servers[key]
+		return []openwechat.BotPreparer{
+			openwechat.BotPreparerFunc(func(bot *openwechat.Bot) { server.Install(bot.Caller.Client) }),
+			openwechat.BotPreparerFunc(func(bot *openwechat.Bot) {
+				bot.UUIDCallback = func(uuid string) { _ = server.ScanAndConfirm(uuid) }
+			}),
+		}
+	}
+	received := make(chan string, 4)
+	manager.MessageHandler = func(msg *openwechat.Message) {
+		key, _ := manager.KeyOf(msg.Bot())
+		received <- key + ":" + msg.Content
+	}
+	manager.Handle("bob", func(msg *openwechat.Message) {
+		if msg.Content == "panic" {
+			panic("boom")
+		}
+		received <- "bob-only:" + msg.Content
+	})
+	if err := manager.Start("alice", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.Start("alice"); !errors.Is(err, openwechat.ErrAccountRunning) {
+		t.Errorf("expect ErrAccountRunning, got %v", err)
+	}
+	if status := manager.Status(); status.Online != 2 || status.Total != 2 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	receive := func(expect string) {
+		t.Helper()
+		select {
+		case content := <-received:
+			if content != expect {
+				t.Errorf("expect %s, got %s", expect, content)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s not received", expect)
+		}
+	}
+	servers["alice"].ReceiveText("@friend", "hello")
+	receive("alice:hello")
+	servers["bob"].ReceiveText("@friend", "hello")
+	receive("bob-only:hello")
+
+	// 一个账号的处理函数 panic 不会影响其他账号
+	bob, _ := manager.Bot("bob")
+	servers["bob"].ReceiveText("@friend", "panic")
+	select {
+	case <-bob.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("bob still alive after panic")
+	}
+	servers["alice"].ReceiveText("@friend", "still here")
+	receive("alice:still here")
+	status := manager.Status()
+	if status.Online != 1 || status.Crashed != 1 || status.Accounts[1].Err == nil {
+		t.Errorf("unexpected status after crash: %+v", status)
+	}
+
+	// 重启之后使用热登录, 不需要重新扫码
+	if err := manager.Restart("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if servers["bob"].Calls("jslogin") != 1 {
+		t.Errorf("restart should use hot login, got %d qrcode requests", servers["bob"].Calls("jslogin"))
+	}
+	servers["bob"].ReceiveText("@friend", "back")
+	receive("bob-only:back")
+	if c := closed("bob"); len(c) != 2 || !c[0] || c[1] {
+		t.Errorf("expect only the crashed storage closed, got %v", c)
+	}
+
+	if err := manager.Stop("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if keys := manager.Keys(); len(keys) != 2 || keys[0] != "alice" {
+		t.Errorf("unexpected keys: %v", keys)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for manager.Status().Stopped != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := manager.Status(); status.Stopped != 1 || status.Online != 1 {
+		t.Errorf("unexpected status after stop: %+v", status)
+	}
+	if c := closed("alice"); len(c) != 1 || !c[0] {
+		t.Errorf("expect storage closed after stop, got %v", c)
+	}
+}
+
+// closeTracker 记录热存储是否被关闭
+type closeTracker struct {
+	io.ReadWriteCloser
+	closed atomic.Bool
+}
+
+func (c *closeTracker) Close() error {
+	c.closed.Store(true)
+	return c.ReadWriteCloser.Close()
+}
+
+func TestLoginPortal(t *testing.T) {
+	server := newTestServer(t)
+	bot, _ := newBot(t, server)
+	portal := openwechat.NewLoginPortal(bot)
+	web := httptest.NewServer(http.StripPrefix("/wechat", portal))
+	t.Cleanup(web.Close)
+	// LoginPortal 通过订阅获取登录状态, 之后设置的回调不会影响它
+	uuids := make(chan string, 8)
+	bot.UUIDCallback = func(uuid string) { uuids <- uuid }
+
+	resp, err := http.Get(web.URL + "/wechat/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	events := make(chan openwechat.LoginEvent, 8)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			var event openwechat.LoginEvent
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok && json.Unmarshal([]byte(data), &event) == nil {
+				events <- event
+			}
+		}
+	}()
+	next := func(expect openwechat.LoginState) openwechat.LoginEvent {
+		t.Helper()
+		select {
+		case event := <-events:
+			if event.State != expect {
+				t.Fatalf("expect %s, got %+v", expect, event)
+			}
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s not received", expect)
+		}
+		return openwechat.LoginEvent{}
+	}
+	next(openwechat.LoginStateIdle)
+
+	if resp, err := http.Get(web.URL + "/wechat/qrcode.png"); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expect no qrcode before login, got %v %v", resp, err)
+	}
+	if resp, err := http.Post(web.URL+"/wechat/login", "", nil); err != nil || resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("start login: %v %v", resp, err)
+	}
+	_ = server.Expire(next(openwechat.LoginStateWaiting).UUID)
+	next(openwechat.LoginStateExpired)
+
+	// 二维码过期之后只推送一次 expired, 重新登录时下一个事件就是 waiting
+	for {
+		resp, err := http.Post(web.URL+"/wechat/login", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode == http.StatusAccepted {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	uuid := next(openwechat.LoginStateWaiting).UUID
+	if len(uuids) != 2 {
+		t.Errorf("expect UUIDCallback to be called twice, got %d", len(uuids))
+	}
+	if resp, err := http.Post(web.URL+"/wechat/login", "", nil); err != nil || resp.StatusCode != http.StatusConflict {
+		t.Errorf("expect conflict while login is running, got %v %v", resp, err)
+	}
+	qrcode, err := http.Get(web.URL + "/wechat/qrcode.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = qrcode.Body.Close()
+	if qrcode.StatusCode != http.StatusOK || qrcode.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("unexpected qrcode response: %d %s", qrcode.StatusCode, qrcode.Header.Get("Content-Type"))
+	}
+
+	_ = server.Scan(uuid)
+	if event := next(openwechat.LoginStateScanned); !strings.HasPrefix(event.Avatar, "data:") {
+		t.Errorf("expect avatar, got %q", event.Avatar)
+	}
+	_ = server.Confirm(uuid)
+	next(openwechat.LoginStateConfirmed)
+	if !bot.Alive() {
+		t.Error("expect bot to be alive")
+	}
+
+	guarded := openwechat.NewLoginPortal(bot)
+	guarded.Authorize = func(r *http.Request) bool { return r.Header.Get("X-Token") == "token" }
+	guardedWeb := httptest.NewServer(guarded)
+	t.Cleanup(guardedWeb.Close)
+	if resp, err := http.Get(guardedWeb.URL); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expect forbidden without token, got %v %v", resp, err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, guardedWeb.URL, nil)
+	req.Header.Set("X-Token", "token")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("expect ok with token, got %v %v", resp, err)
+	}
+}
+
+func TestModeFallbackOption(t *testing.T) {
+	server := newTestServer(t)
+	server.SetRequireDesktop(true)
+
+	bot, exit := newBot(t, server)
+	bot.UUIDCallback = func(uuid string) { _ = server.ScanAndConfirm(uuid) }
+	if err := bot.Login(); err == nil {
+		t.Fatal("expect login environment error in normal mode")
+	}
+	exit()
+
+	bot, _ = newBot(t, server)
+	bot.UUIDCallback = func(uuid string) { _ = server.ScanAndConfirm(uuid) }
+	var cause error
+	fallback := openwechat.NewModeFallbackOption()
+	fallback.OnFallback = func(err error) { cause = err }
+	if err := bot.LoginWith(&openwechat.ScanLogin{}, fallback); err != nil {
+		t.Fatal(err)
+	}
+	if !fallback.FellBack() || fallback.ModeName() != "desktop" || cause == nil {
+		t.Errorf("unexpected fallback: fellBack=%v mode=%s cause=%v", fallback.FellBack(), fallback.ModeName(), cause)
+	}
+
+	// 同一个 ModeFallbackOption 在之后的登录中依然可以切换
+	bot, _ = newBot(t, server)
+	bot.UUIDCallback = func(uuid string) { _ = server.ScanAndConfirm(uuid) }
+	cause = nil
+	if err := bot.LoginWith(&openwechat.ScanLogin{}, fallback); err != nil {
+		t.Fatal(err)
+	}
+	if !fallback.FellBack() || cause == nil {
+		t.Errorf("expect fallback on the second login, got fellBack=%v cause=%v", fallback.FellBack(), cause)
+	}
+
+	// 不需要切换的登录会重置状态
+	server.SetRequireDesktop(false)
+	bot, _ = newBot(t, server)
+	bot.UUIDCallback = func(uuid string) { _ = server.ScanAndConfirm(uuid) }
+	if err := bot.LoginWith(&openwechat.ScanLogin{}, fallback); err != nil {
+		t.Fatal(err)
+	}
+	if fallback.FellBack() || fallback.ModeName() != "normal" {
+		t.Errorf("unexpected fallback: fellBack=%v mode=%s", fallback.FellBack(), fallback.ModeName())
+	}
+}
+
+type headerRecorder struct {
+	base      http.RoundTripper
+	userAgent chan string
+}
+
+func (h *headerRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("X-Test") == "custom" {
+		select {
+		case h.userAgent <- req.Header.Get("User-Agent"):
+		default:
+		}
+	}
+	return h.base.RoundTrip(req)
+}
+
+func TestCustomMode(t *testing.T) {
+	server := newTestServer(t)
+	server.SetRequireDesktop(true)
+	config := openwechat.DesktopModeConfig()
+	config.UserAgent = "openwechattest/1.0"
+	config.Header = http.Header{"X-Test": {"custom"}}
+	openwechat.RegisterMode("openwechattest", openwechat.NewMode(config))
+
+	bot, _ := newBot(t, server, openwechat.WithModeName("openwechattest"))
+	recorder := &headerRecorder{base: bot.Caller.Client.HTTPClient().Transport, userAgent: make(chan string, 1)}
+	bot.Caller.Client.HTTPClient().Transport = recorder
+	login(t, server, bot)
+	select {
+	case userAgent := <-recorder.userAgent:
+		if userAgent != config.UserAgent {
+			t.Errorf("unexpected user agent: %s", userAgent)
+		}
+	default:
+		t.Error("custom header not sent")
+	}
+	if mode, _ := openwechat.LookupMode("openwechattest"); bot.Caller.Client.Mode() != mode {
+		t.Error("expect registered mode to be used")
+	}
+
+	// 没有注册的模式在登录时返回错误
+	other, _ := newBot(t, server, openwechat.WithModeName("openwechattest-missing"))
+	if err := other.Login(); !errors.Is(err, openwechat.ErrModeNotRegistered) {
+		t.Errorf("expect ErrModeNotRegistered, got %v", err)
+	}
+}
+
+func TestDomainFailover(t *testing.T) {
+	server := newTestServer(t)
+	filename := filepath.Join(t.TempDir(), "storage.json")
+	storage := openwechat.NewFileHotReloadStorage(filename)
+	t.Cleanup(func() { _ = storage.Close() })
+	switched := make(chan openwechat.WechatDomain, 1)
+	failover := &openwechat.DomainFailover{
+		OnSwitch: func(from, to openwechat.WechatDomain) { switched <- to },
+	}
+	bot, _ := newBot(t, server, openwechat.WithDomainFailover(failover))
+	received := make(chan string, 1)
+	bot.MessageHandler = func(msg *openwechat.Message) { received <- msg.Content }
+	bot.UUIDCallback = func(uuid string) { _ = server.ScanAndConfirm(uuid) }
+	if err := bot.HotLogin(storage, openwechat.NewRetryLoginOption()); err != nil {
+		t.Fatal(err)
+	}
+	self, err := bot.GetCurrentUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	friends, err := self.Friends()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 切换域名的同时在其他 goroutine 中发送消息, 配合 -race 检查域名的读写
+	stop := make(chan struct{})
+	sending := make(chan struct{})
+	go func() {
+		defer close(sending)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				_, _ = friends.First().SendText("ping")
+			}
+		}
+	}()
+	server.BlockHost("webpush.wx.qq.com", true)
+	defer func() {
+		close(stop)
+		<-sending
+	}()
+	select {
+	case domain := <-switched:
+		if domain != "wx2.qq.com" || bot.Caller.Client.Domain() != domain {
+			t.Errorf("unexpected domain: %s", domain)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("domain not switched")
+	}
+	server.ReceiveText("@friend", "after failover")
+	select {
+	case content := <-received:
+		if content != "after failover" {
+			t.Errorf("unexpected message: %s", content)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received after failover")
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("wx2.qq.com")) {
+		t.Error("expect switched domain to be saved in hot reload storage")
+	}
+}
+
+func TestDomainFailoverServerError(t *testing.T) {
+	server := newTestServer(t)
+	switched := make(chan openwechat.WechatDomain, 1)
+	failover := &openwechat.DomainFailover{
+		MaxFailures: 1,
+		OnSwitch:    func(from, to openwechat.WechatDomain) { switched <- to },
+	}
+	bot, _ := newBot(t, server, openwechat.WithDomainFailover(failover), openwechat.BotPreparerFunc(func(bot *openwechat.Bot) {
+		bot.Caller.Client.MaxRetryTimes = 2
+	}))
+	received := make(chan string, 1)
+	bot.MessageHandler = func(msg *openwechat.Message) { received <- msg.Content }
+	login(t, server, bot)
+
+	// 5xx 跟网络错误一样会重试, 重试之后依然失败时切换域名, 探测请求不会再失败
+	server.Fail("synccheck", 2, http.StatusServiceUnavailable, 0)
+	select {
+	case domain := <-switched:
+		if domain != "wx2.qq.com" {
+			t.Errorf("unexpected domain: %s", domain)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("domain not switched after 503")
+	}
+	server.ReceiveText("@friend", "after 503")
+	select {
+	case content := <-received:
+		if content != "after 503" {
+			t.Errorf("unexpected message: %s", content)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received after failover")
+	}
+}
+
+func TestSessionLease(t *testing.T) {
+	server := newTestServer(t)
+	filename := filepath.Join(t.TempDir(), "storage.json")
+	storage := func() openwechat.HotReloadStorage {
+		storage := openwechat.NewFileHotReloadStorage(filename)
+		t.Cleanup(func() { _ = storage.Close() })
+		return storage
+	}
+	newLease := func() *openwechat.SessionLease { return &openwechat.SessionLease{TTL: 300 * time.Millisecond} }
+
+	first := newLease()
+	bot, exit := newBot(t, server, openwechat.WithSessionLease(first))
+	bot.UUIDCallback = func(uuid string) { _ = server.ScanAndConfirm(uuid) }
+	if err := bot.HotLogin(storage(), openwechat.NewRetryLoginOption()); err != nil {
+		t.Fatal(err)
+	}
+	if first.Path != filename+".lock" || !first.Held() {
+		t.Fatalf("expect lease on %s to be held", first.Path)
+	}
+
+	// 另一个副本使用同一份热存储数据时不能登录, 也不能退回到扫码登录
+	second := newLease()
+	replica, _ := newBot(t, server, openwechat.WithSessionLease(second))
+	if err := replica.HotLogin(storage(), openwechat.NewRetryLoginOption()); !errors.Is(err, openwechat.ErrSessionLocked) {
+		t.Fatalf("expect session locked, got %v", err)
+	}
+	chain := openwechat.ChainLogin(openwechat.NewPushLogin(storage()), &openwechat.ScanLogin{})
+	if err := replica.LoginWith(chain); !errors.Is(err, openwechat.ErrSessionLocked) || len(chain.Attempts()) != 1 {
+		t.Fatalf("expect chain to stop at locked session, got %v", err)
+	}
+	if server.Calls("jslogin") != 1 {
+		t.Errorf("locked session should not fall back to scan login")
+	}
+
+	exit()
+	for deadline := time.Now().Add(time.Second); first.Held() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := replica.HotLogin(storage()); err != nil {
+		t.Fatal(err)
+	}
+
+	// 租约被其他进程接管之后退出
+	if err := os.WriteFile(second.Path, []byte(`{"id":"other","heartbeat":"`+time.Now().Format(time.RFC3339Nano)+`"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-replica.Context().Done():
+		if !errors.Is(replica.CrashReason(), openwechat.ErrSessionLeaseLost) {
+			t.Errorf("unexpected crash reason: %v", replica.CrashReason())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("bot should exit after lease is taken over")
+	}
+}
+
+func TestSessionLeaseTakeOver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json.lock")
+	// 心跳间隔很长, 在其他副本看来很快就会失去响应
+	hung := &openwechat.SessionLease{Path: path, TTL: time.Hour}
+	if err := hung.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = hung.Release() })
+
+	lease := &openwechat.SessionLease{Path: path, TTL: 200 * time.Millisecond}
+	if err := lease.Acquire(); !errors.Is(err, openwechat.ErrSessionLocked) {
+		t.Fatalf("expect session locked, got %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if err := lease.Acquire(); !errors.Is(err, openwechat.ErrSessionLocked) {
+		t.Fatalf("stale lease should not be taken over by default, got %v", err)
+	}
+	lease.TakeOver = true
+	if err := lease.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = lease.Release() })
+	if owner, err := lease.Owner(); err != nil || owner.PID != os.Getpid() || owner.Locked {
+		t.Errorf("unexpected owner after take over: %+v %v", owner, err)
+	}
+
+	// 原进程释放文件锁之后, 接管的进程补上文件锁
+	if err := hung.Release(); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if owner, _ := lease.Owner(); owner.Locked {
+			return
+		}
+	}
+	t.Error("expect lease to acquire the file lock after the hung process released it")
+}
+
+func TestSessionLeaseEmptyLockFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("flock is not supported")
+	}
+	path := filepath.Join(t.TempDir(), "storage.json.lock")
+	holder := &openwechat.SessionLease{Path: path, TTL: time.Hour}
+	if err := holder.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = holder.Release() })
+
+	// 持有者正在写入心跳时锁文件可能是空的或者不完整的, 文件锁依然被持有
+	for _, content := range []string{"", `{"id":`} {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		lease := &openwechat.SessionLease{Path: path, TTL: time.Hour}
+		if err := lease.Acquire(); !errors.Is(err, openwechat.ErrSessionLocked) {
+			t.Errorf("expect session locked with lock file %q, got %v", content, err)
+			_ = lease.Release()
+		}
+	}
+}
+
+func TestProbeHotReload(t *testing.T) {
+	server := newTestServer(t)
+	filename := filepath.Join(t.TempDir(), "storage.json")
+	storage := openwechat.NewFileHotReloadStorage(filename)
+	t.Cleanup(func() { _ = storage.Close() })
+
+	bot, exit := newBot(t, server)
+	login(t, server, bot)
+	if err := bot.DumpTo(storage); err != nil {
+		t.Fatal(err)
+	}
+	exit()
+	saved, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notified := server.Calls("webwxstatusnotify")
+
+	probe, _ := newBot(t, server)
+	status, err := probe.ProbeHotReload(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Usable() || status.User == nil || status.User.UserName != server.Self().UserName {
+		t.Fatalf("expect session to be usable, got %+v", status)
+	}
+	if status.Domain != "wx.qq.com" || !status.HasDataTicket || status.SavedAt.IsZero() {
+		t.Errorf("unexpected status: %+v", status)
+	}
+	if probe.Alive() || server.Calls("webwxstatusnotify") != notified {
+		t.Error("probe should not login or notify the phone")
+	}
+	if data, _ := os.ReadFile(filename); !bytes.Equal(data, saved) {
+		t.Error("probe should not rewrite the storage")
+	}
+
+	server.Kick(openwechat.Ret(1101))
+	status, err = probe.ProbeHotReload(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ret openwechat.Ret
+	if status.Usable() || !errors.As(status.SyncCheckErr, &ret) || ret != 1101 || status.User != nil {
+		t.Errorf("expect session to be invalid, got %+v", status)
+	}
+	if _, err = probe.ProbeHotReload(openwechat.NewFileHotReloadStorage(filepath.Join(t.TempDir(), "missing.json"))); !errors.Is(err, openwechat.ErrInvalidStorage) {
+		t.Errorf("expect invalid storage, got %v", err)
+	}
+}
+
+func TestExitReason(t *testing.T) {
+	tests := []struct {
+		name string
+		exit func(server *Server, bot *openwechat.Bot, cancel context.CancelFunc)
+		kind openwechat.ExitKind
+	}{
+		{"phone logout", func(server *Server, _ *openwechat.Bot, _ context.CancelFunc) { server.Logout() }, openwechat.ExitPhoneLogout},
+		{"logged in elsewhere", func(server *Server, _ *openwechat.Bot, _ context.CancelFunc) { server.Kick(openwechat.Ret(1100)) }, openwechat.ExitLoggedInElsewhere},
+		{"cookie invalid", func(server *Server, _ *openwechat.Bot, _ context.CancelFunc) { server.Kick(openwechat.Ret(1102)) }, openwechat.ExitCookieInvalid},
+		{"user logout", func(_ *Server, bot *openwechat.Bot, _ context.CancelFunc) { _ = bot.Logout() }, openwechat.ExitUserLogout},
+		{"context canceled", func(_ *Server, _ *openwechat.Bot, cancel context.CancelFunc) { cancel() }, openwechat.ExitContextCanceled},
+		{"network failure", func(server *Server, _ *openwechat.Bot, _ context.CancelFunc) {
+			server.BlockHost("webpush.wx.qq.com", true)
+		}, openwechat.ExitNetworkFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestServer(t)
+			bot, cancel := newBot(t, server)
+			bot.MessageErrorHandler = func(err error) error { return err }
+			login(t, server, bot)
+			tt.exit(server, bot, cancel)
+			select {
+			case <-bot.Context().Done():
+				var reason *openwechat.ExitReason
+				if err := bot.CrashReason(); !errors.As(err, &reason) || reason.Kind != tt.kind || reason.Err == nil {
+					t.Errorf("expect %s, got %v", tt.kind, err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("bot still alive")
+			}
+		})
+	}
+
+	server := newTestServer(t)
+	bot, _ := newBot(t, server)
+	login(t, server, bot)
+	bot.Exit()
+	if err := bot.CrashReason(); err != nil {
+		t.Errorf("expect no crash reason after Exit, got %v", err)
+	}
+
+	// 默认的 MessageErrorHandler 保留原始的 *APIError
+	server = newTestServer(t)
+	bot, _ = newBot(t, server)
+	login(t, server, bot)
+	server.Kick(openwechat.Ret(1102))
+	select {
+	case <-bot.Context().Done():
+		var apiErr *openwechat.APIError
+		if err := bot.CrashReason(); !errors.As(err, &apiErr) || apiErr.Ret != 1102 {
+			t.Errorf("expect *APIError with ret 1102, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("bot still alive")
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	server := newTestServer(t)
+	bot, _ := newBot(t, server)
+	login(t, server, bot)
+	server.Kick(openwechat.Ret(1101))
+
+	_, err := bot.Caller.WebInit(context.Background(), bot.Storage.Request)
+	var apiError *openwechat.APIError
+	if !errors.As(err, &apiError) || apiError.Endpoint != "webwxinit" || apiError.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+	if !errors.Is(err, openwechat.RetFailedLoginCheck) || !openwechat.IsSessionExpired(err) {
+		t.Errorf("expect session expired, got %v", err)
+	}
+	err = bot.Caller.WebWxRenameChatRoom(context.Background(), &openwechat.CallerWebWxRenameChatRoomOptions{
+		BaseRequest: bot.Storage.Request,
+		LoginInfo:   bot.Storage.LoginInfo,
+		NewTopic:    "topic",
+		Group:       &openwechat.Group{User: &openwechat.User{UserName: "@@group"}},
+	})
+	if !errors.As(err, &apiError) || apiError.Endpoint != "webwxupdatechatroom" {
+		t.Errorf("unexpected error: %#v", err)
+	}
+}
+
+// attemptCounter 记录每个接口经过 HttpHooks 的请求次数
+type attemptCounter struct {
+	mu       sync.Mutex
+	attempts map[string]int
+}
+
+func (a *attemptCounter) BeforeRequest(req *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.attempts[path.Base(req.URL.Path)]++
+}
+
+func (a *attemptCounter) AfterRequest(*http.Response, error) {}
+
+func (a *attemptCounter) count(endpoint string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.attempts[endpoint]
+}
+
+func TestRetryPolicy(t *testing.T) {
+	server := newTestServer(t)
+	counter := &attemptCounter{attempts: make(map[string]int)}
+	// 消息同步在后台使用同一个 Client, 测试过程中通过加锁切换策略
+	var mu sync.Mutex
+	var policy openwechat.RetryPolicy = &openwechat.BackoffRetryPolicy{MaxAttempts: 3, BaseDelay: 10 * time.Millisecond, Jitter: 0.2}
+	setPolicy := func(p openwechat.RetryPolicy) {
+		mu.Lock()
+		defer mu.Unlock()
+		policy = p
+	}
+	bot, _ := newBot(t, server, openwechat.BotPreparerFunc(func(bot *openwechat.Bot) {
+		bot.Caller.Client.AddHttpHook(counter)
+		bot.Caller.Client.RetryPolicy = openwechat.RetryPolicyFunc(func(req *http.Request, attempt int, err error) (time.Duration, bool) {
+			mu.Lock()
+			defer mu.Unlock()
+			return policy.Backoff(req, attempt, err)
+		})
+	}))
+	login(t, server, bot)
+	ctx := context.Background()
+
+	// 5xx 和系统错误都会重试
+	before := counter.count("webwxinit")
+	server.Fail("webwxinit", 1, http.StatusServiceUnavailable, 0)
+	server.Fail("webwxinit", 1, 0, openwechat.RetSysError)
+	if _, err := bot.Caller.WebInit(ctx, bot.Storage.Request); err != nil {
+		t.Fatal(err)
+	}
+	if attempts := counter.count("webwxinit") - before; attempts != 3 {
+		t.Errorf("expect 3 attempts visible to hooks, got %d", attempts)
+	}
+
+	// 超过最大次数之后返回最后一次的错误
+	server.Fail("webwxinit", 3, 0, openwechat.RetSysError)
+	if _, err := bot.Caller.WebInit(ctx, bot.Storage.Request); !errors.Is(err, openwechat.RetSysError) {
+		t.Errorf("expect sys error, got %v", err)
+	}
+
+	// 发送消息默认不重试
+	send := func() error {
+		_, err := bot.Caller.WebWxSendMsg(ctx, &openwechat.CallerWebWxSendMsgOptions{
+			LoginInfo:   bot.Storage.LoginInfo,
+			BaseRequest: bot.Storage.Request,
+			Message:     openwechat.NewTextSendMessage("retry", server.Self().UserName, "@friend"),
+		})
+		return err
+	}
+	server.Fail("webwxsendmsg", 1, http.StatusBadGateway, 0)
+	if err := send(); !openwechat.IsRetryable(err) || counter.count("webwxsendmsg") != 1 {
+		t.Errorf("send should not be retried, got %v after %d attempts", err, counter.count("webwxsendmsg"))
+	}
+	setPolicy(&openwechat.BackoffRetryPolicy{
+		BaseDelay: 10 * time.Millisecond,
+		Endpoints: map[string]openwechat.RetryPolicy{
+			"webwxsendmsg": &openwechat.BackoffRetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, AllowNonIdempotent: true},
+		},
+	})
+	server.Fail("webwxsendmsg", 1, http.StatusBadGateway, 0)
+	if err := send(); err != nil || len(server.Sent()) != 1 {
+		t.Errorf("expect send to succeed after retry, got %v", err)
+	}
+
+	// 等待重试时 context 被取消
+	setPolicy(&openwechat.BackoffRetryPolicy{BaseDelay: time.Hour})
+	server.Fail("webwxinit", 1, http.StatusServiceUnavailable, 0)
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := bot.Caller.WebInit(timeout, bot.Storage.Request); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expect deadline exceeded, got %v", err)
+	}
+}
+
+func TestContactSync(t *testing.T) {
+	server := newTestServer(t)
+	server.AddContact(
+		&openwechat.User{UserName: "@gone", NickName: "gone"},
+		&openwechat.User{UserName: "@@group", NickName: "group", MemberList: openwechat.Members{
+			{UserName: "@friend", NickName: "friend"},
+		}},
+	)
+	bot, _ := newBot(t, server)
+	received := make(chan struct{}, 1)
+	bot.MessageHandler = func(msg *openwechat.Message) { received <- struct{}{} }
+	login(t, server, bot)
+
+	self, err := bot.GetCurrentUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	friends, err := self.Friends()
+	if err != nil {
+		t.Fatal(err)
+	}
+	friend := friends.SearchByUserName(1, "@friend").First()
+	if friend == nil {
+		t.Fatal("expect @friend in friends")
+	}
+	groups, err := self.Groups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	group := groups.SearchByUserName(1, "@@group").First()
+	if group == nil {
+		t.Fatal("expect @@group in groups")
+	}
+
+	server.ModifyContact(&openwechat.User{UserName: "@friend", NickName: "renamed", RemarkName: "remark"})
+	server.AddContact(&openwechat.User{UserName: "@new", NickName: "new"})
+	server.DeleteContact("@gone")
+	server.ModifyChatRoomMembers(&openwechat.User{UserName: "@@group", NickName: "group", MemberList: openwechat.Members{
+		{UserName: "@friend", NickName: "friend"},
+		{UserName: "@new", NickName: "new"},
+	}})
+	// 消息在联系人变更之后推送, 收到消息时变更已经合并到缓存中
+	server.ReceiveText("@friend", "done")
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+	}
+
+	if friend.NickName != "renamed" || friend.RemarkName != "remark" {
+		t.Errorf("expect friend updated in place, got %s %s", friend.NickName, friend.RemarkName)
+	}
+	if friend.Self() != self {
+		t.Error("expect updated friend bound to self")
+	}
+	friends, _ = self.Friends()
+	if friends.SearchByUserName(1, "@new").Count() != 1 {
+		t.Error("expect @new added to friends")
+	}
+	if friends.SearchByUserName(1, "@gone").Count() != 0 {
+		t.Error("expect @gone removed from friends")
+	}
+	if group.MemberList.Count() != 2 || group.MemberList.SearchByUserName(1, "@new").Count() != 1 {
+		t.Errorf("expect group members updated, got %v", group.MemberList)
+	}
+	if calls := server.Calls("webwxgetcontact"); calls != 1 {
+		t.Errorf("expect contacts loaded once, got %d", calls)
+	}
+}
+
+func TestContactEvents(t *testing.T) {
+	server := newTestServer(t)
+	server.AddContact(
+		&openwechat.User{UserName: "@gone", NickName: "gone"},
+		&openwechat.User{UserName: "@@group", NickName: "group", MemberList: openwechat.Members{
+			{UserName: "@friend", NickName: "friend"},
+			{UserName: "@gone", NickName: "gone"},
+		}},
+	)
+	bot, _ := newBot(t, server)
+	var events []*openwechat.ContactEvent
+	var joined []string
+	bot.OnContactEvent(func(event *openwechat.ContactEvent) { events = append(events, event) })
+	bot.OnContactEvent(func(event *openwechat.ContactEvent) {
+		joined = append(joined, event.Member.UserName)
+	}, openwechat.GroupMemberJoined)
+	received := make(chan struct{}, 1)
+	bot.MessageHandler = func(msg *openwechat.Message) { received <- struct{}{} }
+	login(t, server, bot)
+
+	// 消息同步加载完联系人之后才会开始同步检查, 等到这时再修改
+	deadline := time.Now().Add(5 * time.Second)
+	for server.Calls("synccheck") == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	server.AddContact(&openwechat.User{UserName: "@new", NickName: "new"})
+	server.ModifyContact(&openwechat.User{UserName: "@friend", NickName: "friend", RemarkName: "remark", HeadImgUrl: "/avatar"})
+	server.DeleteContact("@gone")
+	server.ModifyChatRoomMembers(&openwechat.User{UserName: "@@group", NickName: "renamed", MemberList: openwechat.Members{
+		{UserName: "@friend", NickName: "friend"},
+		{UserName: "@new", NickName: "new"},
+	}})
+	server.ReceiveText("@friend", "done")
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+	}
+
+	byType := make(map[openwechat.ContactEventType][]*openwechat.ContactEvent)
+	for _, event := range events {
+		byType[event.Type] = append(byType[event.Type], event)
+	}
+	if e := byType[openwechat.ContactAdded]; len(e) != 1 || e[0].Contact.UserName != "@new" {
+		t.Errorf("expect @new added, got %v", e)
+	}
+	if e := byType[openwechat.ContactRemoved]; len(e) != 1 || e[0].Contact.NickName != "gone" {
+		t.Errorf("expect @gone removed, got %v", e)
+	}
+	if e := byType[openwechat.ContactModified]; len(e) != 1 {
+		t.Errorf("expect one modified event, got %v", e)
+	} else {
+		if change, ok := e[0].Changed(openwechat.FieldRemarkName); !ok || change.Old != "" || change.New != "remark" {
+			t.Errorf("expect remark change, got %+v", e[0].Changes)
+		}
+		if _, ok := e[0].Changed(openwechat.FieldHeadImgUrl); !ok {
+			t.Errorf("expect avatar change, got %+v", e[0].Changes)
+		}
+		if _, ok := e[0].Changed(openwechat.FieldNickName); ok {
+			t.Errorf("nickname should not change, got %+v", e[0].Changes)
+		}
+	}
+	if e := byType[openwechat.GroupRenamed]; len(e) != 1 || e[0].Changes[0].Old != "group" || e[0].Changes[0].New != "renamed" {
+		t.Errorf("expect group renamed, got %v", e)
+	}
+	if e := byType[openwechat.GroupMemberLeft]; len(e) != 1 || e[0].Member.UserName != "@gone" {
+		t.Errorf("expect @gone left group, got %v", e)
+	}
+	if len(joined) != 1 || joined[0] != "@new" {
+		t.Errorf("expect @new joined group, got %v", joined)
+	}
+}
+
+func TestContactEventsAfterReconnect(t *testing.T) {
+	server := newTestServer(t)
+	attempts := make(chan error, 1)
+	reconnector := &openwechat.Reconnector{
+		MaxAttempts: 1,
+		Timeout:     300 * time.Millisecond,
+		Backoff:     func(int) time.Duration { return time.Millisecond },
+		OnAttempt:   func(attempt int, err error) { attempts <- err },
+	}
+	bot, _ := newBot(t, server, openwechat.WithReconnector(reconnector))
+	var events []*openwechat.ContactEvent
+	bot.OnContactEvent(func(event *openwechat.ContactEvent) { events = append(events, event) })
+	received := make(chan struct{}, 1)
+	bot.MessageHandler = func(msg *openwechat.Message) { received <- struct{}{} }
+	login(t, server, bot)
+
+	// 重新登录之后 Self 被替换, 依然可以收到联系人变更事件
+	server.SetAutoConfirm(true)
+	server.Kick(openwechat.Ret(1102))
+	select {
+	case err := <-attempts:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reconnect not attempted")
+	}
+	server.ModifyContact(&openwechat.User{UserName: "@friend", NickName: "friend", RemarkName: "remark"})
+	server.ReceiveText("@friend", "done")
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+	}
+	if len(events) != 1 || events[0].Type != openwechat.ContactModified {
+		t.Fatalf("expect one modified event, got %v", events)
+	}
+	if change, ok := events[0].Changed(openwechat.FieldRemarkName); !ok || change.New != "remark" {
+		t.Errorf("expect remark change, got %+v", events[0].Changes)
+	}
+}
+func TestEventBus(t *testing.T) {
+	server := newTestServer(t)
+	bot, _ := newBot(t, server)
+	var mu sync.Mutex
+	var order []string
+	record := func(name string) {
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, name)
+	}
+	bot.MessageHandler = func(msg *openwechat.Message) { record("handler:" + msg.Content) }
+	bot.LogoutCallBack = func(*openwechat.Bot) { record("logout") }
+	bot.Subscribe(func(event *openwechat.Event) {
+		switch event.Type {
+		case openwechat.EventSyncCheck:
+		case openwechat.EventMessage:
+			record("all:" + event.Message.Content)
+		default:
+			record(event.Type.String())
+		}
+	})
+	bot.Subscribe(func(event *openwechat.Event) { panic("boom") }, openwechat.EventMessage)
+	typed := bot.Subscribe(func(event *openwechat.Event) {
+		record("typed:" + event.Message.Content)
+	}, openwechat.EventMessage)
+	exited := make(chan error, 1)
+	bot.Subscribe(func(event *openwechat.Event) {
+		switch {
+		case event.Type == openwechat.EventExit:
+			exited <- event.Err
+		case event.Message.Content == "exit":
+			// 处理函数中发布的事件在当前事件处理完之后投递
+			bot.Exit()
+			record("after exit")
+		}
+	}, openwechat.EventMessage, openwechat.EventExit)
+	login(t, server, bot)
+
+	received := func(name string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(order) > 0 && order[len(order)-1] == name
+	}
+	server.ReceiveText("@friend", "first")
+	deadline := time.Now().Add(5 * time.Second)
+	for !received("typed:first") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !bot.Unsubscribe(typed) || bot.Unsubscribe(typed) {
+		t.Error("expect unsubscribe to succeed only once")
+	}
+	server.ReceiveText("@friend", "exit")
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Errorf("expect no exit reason, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("exit event not received")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	expect := []string{
+		"UUID", "Scan", "Login", "Confirm",
+		"handler:first", "all:first", "typed:first",
+		"handler:exit", "all:exit", "after exit",
+		"logout", "Exit",
+	}
+	if strings.Join(order, ",") != strings.Join(expect, ",") {
+		t.Errorf("expect events %v, got %v", expect, order)
+	}
+}
+
+func TestExitDeliversLogout(t *testing.T) {
+	server := newTestServer(t)
+	// 同步检查一直等待, 退出时没有其他事件正在投递
+	server.PollTimeout = time.Minute
+	bot, _ := newBot(t, server)
+	var logout atomic.Bool
+	bot.LogoutCallBack = func(*openwechat.Bot) { logout.Store(true) }
+	login(t, server, bot)
+	deadline := time.Now().Add(5 * time.Second)
+	for server.Calls("synccheck") == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	bot.Exit()
+	if !logout.Load() {
+		t.Error("expect LogoutCallBack called before Exit returns")
+	}
+}
+
+func TestSyncDrain(t *testing.T) {
+	server := newTestServer(t)
+	server.SyncBatchSize = 2
+	bot, _ := newBot(t, server, openwechat.WithSyncDrainLimit(3))
+	received := make(chan string, 10)
+	bot.MessageHandler = func(msg *openwechat.Message) { received <- msg.Content }
+	backlogs := make(chan openwechat.SyncBacklog, 10)
+	bot.Subscribe(func(event *openwechat.Event) { backlogs <- *event.Backlog }, openwechat.EventSyncBacklog)
+	login(t, server, bot)
+
+	var messages []*openwechat.Message
+	for i := 0; i < 7; i++ {
+		messages = append(messages, &openwechat.Message{
+			MsgType:      openwechat.MsgTypeText,
+			FromUserName: "@friend",
+			Content:      string(rune('a' + i)),
+		})
+	}
+	before := server.Calls("synccheck")
+	server.ReceiveMessage(messages...)
+
+	var contents []string
+	for len(contents) < len(messages) {
+		select {
+		case content := <-received:
+			contents = append(contents, content)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expect %d messages, got %v", len(messages), contents)
+		}
+	}
+	if strings.Join(contents, "") != "abcdefg" {
+		t.Errorf("expect messages in order, got %v", contents)
+	}
+	// 第一次同步检查拉取三轮 6 条消息, 达到上限之后剩下的 1 条在下一次同步检查之后拉取
+	first := <-backlogs
+	if first.Rounds != 3 || first.Messages != 6 || !first.Remaining {
+		t.Errorf("unexpected backlog %+v", first)
+	}
+	select {
+	case backlog := <-backlogs:
+		t.Errorf("expect no backlog for a single round, got %+v", backlog)
+	default:
+	}
+	if calls := server.Calls("synccheck") - before; calls < 2 {
+		t.Errorf("expect remaining messages fetched after another sync check, got %d sync checks", calls)
+	}
+	if calls := server.Calls("webwxsync"); calls != 4 {
+		t.Errorf("expect 4 webwxsync calls, got %d", calls)
+	}
+}
+
+func TestMessageDeduplication(t *testing.T) {
+	server := newTestServer(t)
+	filename := filepath.Join(t.TempDir(), "msgids.json")
+	text := func(id, content string) *openwechat.Message {
+		return &openwechat.Message{MsgId: id, MsgType: openwechat.MsgTypeText, FromUserName: "@friend", Content: content}
+	}
+	run := func(prepare openwechat.BotPreparer, messages ...*openwechat.Message) []string {
+		bot, cancel := newBot(t, server, prepare)
+		defer cancel()
+		received := make(chan string, len(messages))
+		bot.MessageHandler = func(msg *openwechat.Message) { received <- msg.Content }
+		login(t, server, bot)
+		server.ReceiveMessage(append(messages, text("", "done"))...)
+		var contents []string
+		for {
+			select {
+			case content := <-received:
+				if content == "done" {
+					return contents
+				}
+				contents = append(contents, content)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("done not received, got %v", contents)
+			}
+		}
+	}
+
+	withDedup := func() openwechat.BotPreparer {
+		dedup := openwechat.NewMessageDeduplicator(100, time.Hour)
+		dedup.Storage = openwechat.NewAtomicFileHotReloadStorage(filename, 1)
+		return openwechat.WithMessageDeduplicator(dedup)
+	}
+
+	// 默认过滤重复的消息, 传入 nil 时不过滤
+	if contents := run(openwechat.BotPreparerFunc(func(*openwechat.Bot) {}), text("98", "first"), text("98", "again")); strings.Join(contents, ",") != "first" {
+		t.Errorf("expect duplicates filtered by default, got %v", contents)
+	}
+	if contents := run(openwechat.WithMessageDeduplicator(nil), text("99", "first"), text("99", "again")); strings.Join(contents, ",") != "first,again" {
+		t.Errorf("expect no filtering without deduplicator, got %v", contents)
+	}
+	// 同一次同步中重复推送的消息只处理一次
+	if contents := run(withDedup(), text("100", "first"), text("100", "again"), text("101", "second")); strings.Join(contents, ",") != "first,second" {
+		t.Errorf("expect duplicates filtered, got %v", contents)
+	}
+	// 等待处理完这一轮消息之后写入存储
+	deadline := time.Now().Add(5 * time.Second)
+	for data, _ := os.ReadFile(filename); !bytes.Contains(data, []byte(`"101"`)) && time.Now().Before(deadline); data, _ = os.ReadFile(filename) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// 重启之后从存储中恢复, 已经处理过的消息不会再次处理
+	if contents := run(withDedup(), text("101", "second"), text("102", "third")); strings.Join(contents, ",") != "third" {
+		t.Errorf("expect duplicates filtered after restart, got %v", contents)
+	}
+}
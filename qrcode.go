@@ -0,0 +1,597 @@
+package openwechat
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrQrcodeContentTooLong 二维码内容超出了支持的最大长度
+var ErrQrcodeContentTooLong = errors.New("qrcode content too long")
+
+// QrcodeLevel 二维码纠错等级
+type QrcodeLevel int
+
+const (
+	QrcodeLevelL QrcodeLevel = iota // 约 7% 的纠错能力
+	QrcodeLevelM                    // 约 15% 的纠错能力
+	QrcodeLevelQ                    // 约 25% 的纠错能力
+	QrcodeLevelH                    // 约 30% 的纠错能力
+)
+
+// formatBits 纠错等级在格式信息中的编码
+func (l QrcodeLevel) formatBits() int {
+	return [...]int{1, 0, 3, 2}[l]
+}
+
+// qrcodeBlock 单个版本和纠错等级下的分块信息
+type qrcodeBlock struct {
+	ecLen      int // 每个块的纠错码字数
+	group1     int // 第一组的块数
+	group1Data int // 第一组每块的数据码字数
+	group2     int // 第二组的块数, 每块的数据码字数为 group1Data+1
+}
+
+// qrcodeBlocks 版本 1-10 的分块信息, 按 L M Q H 排列
+var qrcodeBlocks = [...][4]qrcodeBlock{
+	{{7, 1, 19, 0}, {10, 1, 16, 0}, {13, 1, 13, 0}, {17, 1, 9, 0}},
+	{{10, 1, 34, 0}, {16, 1, 28, 0}, {22, 1, 22, 0}, {28, 1, 16, 0}},
+	{{15, 1, 55, 0}, {26, 1, 44, 0}, {18, 2, 17, 0}, {22, 2, 13, 0}},
+	{{20, 1, 80, 0}, {18, 2, 32, 0}, {26, 2, 24, 0}, {16, 4, 9, 0}},
+	{{26, 1, 108, 0}, {24, 2, 43, 0}, {18, 2, 15, 2}, {22, 2, 11, 2}},
+	{{18, 2, 68, 0}, {16, 4, 27, 0}, {24, 4, 19, 0}, {28, 4, 15, 0}},
+	{{20, 2, 78, 0}, {18, 4, 31, 0}, {18, 2, 14, 4}, {26, 4, 13, 1}},
+	{{24, 2, 97, 0}, {22, 2, 38, 2}, {22, 4, 18, 2}, {26, 4, 14, 2}},
+	{{30, 2, 116, 0}, {22, 3, 36, 2}, {20, 4, 16, 4}, {24, 4, 12, 4}},
+	{{18, 2, 68, 2}, {26, 4, 43, 1}, {24, 6, 19, 2}, {28, 6, 15, 2}},
+}
+
+// qrcodeAlignments 版本 1-10 的校正图形中心坐标
+var qrcodeAlignments = [...][]int{
+	nil, {6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34},
+	{6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50},
+}
+
+func (b qrcodeBlock) dataLen() int {
+	return b.group1*b.group1Data + b.group2*(b.group1Data+1)
+}
+
+// Qrcode 二维码
+// 内置的编码器只支持字节模式和版本 1-10, 对于登录二维码来说已经足够
+type Qrcode struct {
+	size       int
+	modules    [][]bool
+	isFunction [][]bool
+}
+
+// NewQrcode 以指定的纠错等级编码 content, 自动选择能容纳内容的最小版本
+func NewQrcode(content string, level QrcodeLevel) (*Qrcode, error) {
+	data := []byte(content)
+	for version := 1; version <= len(qrcodeBlocks); version++ {
+		block := qrcodeBlocks[version-1][level]
+		countBits := 8
+		if version >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+len(data)*8 > block.dataLen()*8 {
+			continue
+		}
+		q := &Qrcode{size: version*4 + 17}
+		q.modules = newQrcodeMatrix(q.size)
+		q.isFunction = newQrcodeMatrix(q.size)
+		q.drawFunctionPatterns(version)
+		q.drawCodewords(qrcodeCodewords(encodeQrcodeData(data, countBits, block.dataLen()), block))
+		q.applyBestMask(level)
+		return q, nil
+	}
+	return nil, ErrQrcodeContentTooLong
+}
+
+// NewLoginQrcode 根据uuid生成登录二维码
+func NewLoginQrcode(uuid string) (*Qrcode, error) {
+	return NewQrcode(GetQrcodeContent(uuid), QrcodeLevelM)
+}
+
+// GetQrcodeContent 通过uuid获取登录二维码的内容
+func GetQrcodeContent(uuid string) string {
+	return qrcodeContent + uuid
+}
+
+// Size 返回二维码每边的模块数, 不包含静区
+func (q *Qrcode) Size() int {
+	return q.size
+}
+
+// Dark 返回 (x, y) 处的模块是否为深色, 超出范围的坐标视为浅色
+func (q *Qrcode) Dark(x, y int) bool {
+	if x < 0 || y < 0 || x >= q.size || y >= q.size {
+		return false
+	}
+	return q.modules[y][x]
+}
+
+// WriteTerminal 使用 UTF-8 半块字符将二维码写入终端, 每个字符表示上下两个模块
+// 浅色模块用字符绘制, 深色模块留空, 适用于深色背景的终端
+func (q *Qrcode) WriteTerminal(writer io.Writer) error {
+	const quiet = 2
+	var builder strings.Builder
+	for y := -quiet; y < q.size+quiet; y += 2 {
+		for x := -quiet; x < q.size+quiet; x++ {
+			upper, lower := !q.Dark(x, y), !q.Dark(x, y+1)
+			if y+1 >= q.size+quiet {
+				lower = false
+			}
+			switch {
+			case upper && lower:
+				builder.WriteString("█")
+			case upper:
+				builder.WriteString("▀")
+			case lower:
+				builder.WriteString("▄")
+			default:
+				builder.WriteByte(' ')
+			}
+		}
+		builder.WriteByte('\n')
+	}
+	_, err := io.WriteString(writer, builder.String())
+	return err
+}
+
+// Image 返回二维码的图像, scale 为每个模块的像素大小, 四周保留 4 个模块的静区
+func (q *Qrcode) Image(scale int) image.Image {
+	const quiet = 4
+	if scale < 1 {
+		scale = 1
+	}
+	length := (q.size + quiet*2) * scale
+	img := image.NewPaletted(image.Rect(0, 0, length, length), color.Palette{color.White, color.Black})
+	for y := 0; y < length; y++ {
+		for x := 0; x < length; x++ {
+			if q.Dark(x/scale-quiet, y/scale-quiet) {
+				img.SetColorIndex(x, y, 1)
+			}
+		}
+	}
+	return img
+}
+
+// WritePNG 将二维码以 png 格式写入 writer
+func (q *Qrcode) WritePNG(writer io.Writer, scale int) error {
+	return png.Encode(writer, q.Image(scale))
+}
+
+// WriteSVG 将二维码以 svg 格式写入 writer
+func (q *Qrcode) WriteSVG(writer io.Writer, scale int) error {
+	const quiet = 4
+	if scale < 1 {
+		scale = 1
+	}
+	length := q.size + quiet*2
+	var builder strings.Builder
+	fmt.Fprintf(&builder, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		length*scale, length*scale, length, length)
+	fmt.Fprintf(&builder, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, length, length)
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				fmt.Fprintf(&builder, "M%d %dh1v1h-1z", x+quiet, y+quiet)
+			}
+		}
+	}
+	builder.WriteString(`"/></svg>`)
+	_, err := io.WriteString(writer, builder.String())
+	return err
+}
+
+// TerminalQrcodeCallback 返回一个 UUIDCallback, 将登录二维码直接打印到 writer 上
+// 适用于无法打开浏览器的服务器环境
+func TerminalQrcodeCallback(writer io.Writer) func(uuid string) {
+	return func(uuid string) {
+		code, err := NewLoginQrcode(uuid)
+		if err != nil {
+			log.Printf("generate qrcode failed: %v", err)
+			return
+		}
+		_, _ = io.WriteString(writer, "请使用微信扫描下面的二维码登录\n")
+		if err = code.WriteTerminal(writer); err != nil {
+			log.Printf("write qrcode failed: %v", err)
+		}
+	}
+}
+
+// FileQrcodeCallback 返回一个 UUIDCallback, 将登录二维码保存到 path
+// 文件后缀为 .svg 时保存为 svg 格式, 否则保存为 png 格式
+func FileQrcodeCallback(path string) func(uuid string) {
+	return func(uuid string) {
+		if err := writeQrcodeFile(path, uuid); err != nil {
+			log.Printf("write qrcode to %s failed: %v", path, err)
+		}
+	}
+}
+
+func writeQrcodeFile(path, uuid string) error {
+	code, err := NewLoginQrcode(uuid)
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".svg") {
+		err = code.WriteSVG(file, 8)
+	} else {
+		err = code.WritePNG(file, 8)
+	}
+	return errors.Join(err, file.Close())
+}
+
+func newQrcodeMatrix(size int) [][]bool {
+	matrix := make([][]bool, size)
+	for i := range matrix {
+		matrix[i] = make([]bool, size)
+	}
+	return matrix
+}
+
+// encodeQrcodeData 以字节模式编码数据, 并填充到 capacity 个码字
+func encodeQrcodeData(data []byte, countBits, capacity int) []byte {
+	var bits []bool
+	appendBits := func(value, length int) {
+		for i := length - 1; i >= 0; i-- {
+			bits = append(bits, (value>>i)&1 == 1)
+		}
+	}
+	appendBits(0b0100, 4)
+	appendBits(len(data), countBits)
+	for _, b := range data {
+		appendBits(int(b), 8)
+	}
+	// 终止符和字节对齐
+	terminator := capacity*8 - len(bits)
+	if terminator > 4 {
+		terminator = 4
+	}
+	appendBits(0, terminator)
+	appendBits(0, (8-len(bits)%8)%8)
+
+	result := make([]byte, 0, capacity)
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for j := 0; j < 8; j++ {
+			if bits[i+j] {
+				b |= 1 << (7 - j)
+			}
+		}
+		result = append(result, b)
+	}
+	for pad := byte(0xEC); len(result) < capacity; pad ^= 0xEC ^ 0x11 {
+		result = append(result, pad)
+	}
+	return result
+}
+
+// qrcodeCodewords 将数据分块并计算纠错码, 按规范交错排列
+func qrcodeCodewords(data []byte, block qrcodeBlock) []byte {
+	var blocks, ecBlocks [][]byte
+	divisor := reedSolomonDivisor(block.ecLen)
+	for i := 0; i < block.group1+block.group2; i++ {
+		length := block.group1Data
+		if i >= block.group1 {
+			length++
+		}
+		blocks = append(blocks, data[:length])
+		ecBlocks = append(ecBlocks, reedSolomonRemainder(data[:length], divisor))
+		data = data[length:]
+	}
+	var result []byte
+	for i := 0; i <= block.group1Data; i++ {
+		for _, b := range blocks {
+			if i < len(b) {
+				result = append(result, b[i])
+			}
+		}
+	}
+	for i := 0; i < block.ecLen; i++ {
+		for _, b := range ecBlocks {
+			result = append(result, b[i])
+		}
+	}
+	return result
+}
+
+// reedSolomonMultiply GF(2^8) 上的乘法, 本原多项式为 0x11D
+func reedSolomonMultiply(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+// reedSolomonDivisor 生成 degree 次的生成多项式, 省略最高次项的系数
+func reedSolomonDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = reedSolomonMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = reedSolomonMultiply(root, 0x02)
+	}
+	return result
+}
+
+func reedSolomonRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, d := range divisor {
+			result[i] ^= reedSolomonMultiply(d, factor)
+		}
+	}
+	return result
+}
+
+func (q *Qrcode) setFunction(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.isFunction[y][x] = true
+}
+
+// drawFunctionPatterns 绘制定位图形, 时序图形, 校正图形以及格式和版本信息区域
+func (q *Qrcode) drawFunctionPatterns(version int) {
+	for i := 0; i < q.size; i++ {
+		q.setFunction(6, i, i%2 == 0)
+		q.setFunction(i, 6, i%2 == 0)
+	}
+	q.drawFinderPattern(3, 3)
+	q.drawFinderPattern(q.size-4, 3)
+	q.drawFinderPattern(3, q.size-4)
+
+	positions := qrcodeAlignments[version-1]
+	last := len(positions) - 1
+	for i, x := range positions {
+		for j, y := range positions {
+			// 与定位图形重叠的位置不绘制
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.setFunction(x+dx, y+dy, chebyshevDistance(dx, dy) != 1)
+				}
+			}
+		}
+	}
+	// 先占位, 选定掩码后再写入真正的格式信息
+	q.drawFormatBits(0)
+	q.drawVersion(version)
+}
+
+func (q *Qrcode) drawFinderPattern(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx >= 0 && xx < q.size && yy >= 0 && yy < q.size {
+				distance := chebyshevDistance(dx, dy)
+				q.setFunction(xx, yy, distance != 2 && distance != 4)
+			}
+		}
+	}
+}
+
+// qrcodeFormatBits 计算 15 位的格式信息, 包含 BCH 校验位和掩码
+func qrcodeFormatBits(level QrcodeLevel, mask int) int {
+	data := level.formatBits()<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+func (q *Qrcode) drawFormatBits(bits int) {
+	bit := func(i int) bool { return (bits>>i)&1 == 1 }
+	for i := 0; i <= 5; i++ {
+		q.setFunction(8, i, bit(i))
+	}
+	q.setFunction(8, 7, bit(6))
+	q.setFunction(8, 8, bit(7))
+	q.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.setFunction(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.setFunction(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.setFunction(8, q.size-15+i, bit(i))
+	}
+	// 固定的深色模块
+	q.setFunction(8, q.size-8, true)
+}
+
+func (q *Qrcode) drawVersion(version int) {
+	if version < 7 {
+		return
+	}
+	rem := version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	bits := version<<12 | rem
+	for i := 0; i < 18; i++ {
+		dark := (bits>>i)&1 == 1
+		a, b := q.size-11+i%3, i/3
+		q.setFunction(a, b, dark)
+		q.setFunction(b, a, dark)
+	}
+}
+
+// drawCodewords 按之字形顺序从右下角开始填充数据模块
+func (q *Qrcode) drawCodewords(data []byte) {
+	var i int
+	for right := q.size - 1; right >= 1; right -= 2 {
+		// 跳过垂直时序图形所在的列
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < q.size; vert++ {
+			y := vert
+			if upward {
+				y = q.size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if !q.isFunction[y][x] && i < len(data)*8 {
+					q.modules[y][x] = (data[i>>3]>>(7-i&7))&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (q *Qrcode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !q.isFunction[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// applyBestMask 依次尝试 8 种掩码, 选择扣分最少的一种
+func (q *Qrcode) applyBestMask(level QrcodeLevel) {
+	best, minPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormatBits(qrcodeFormatBits(level, mask))
+		if penalty := q.penalty(); minPenalty < 0 || penalty < minPenalty {
+			best, minPenalty = mask, penalty
+		}
+		// 掩码是异或操作, 再次应用即可还原
+		q.applyMask(mask)
+	}
+	q.applyMask(best)
+	q.drawFormatBits(qrcodeFormatBits(level, best))
+}
+
+// penalty 按规范中的四条规则计算扣分
+func (q *Qrcode) penalty() int {
+	var result, dark int
+	finderLike := [2][]bool{
+		{true, false, true, true, true, false, true, false, false, false, false},
+		{false, false, false, false, true, false, true, true, true, false, true},
+	}
+	line := make([]bool, q.size)
+	for _, vertical := range []bool{false, true} {
+		for i := 0; i < q.size; i++ {
+			for j := range line {
+				if vertical {
+					line[j] = q.modules[j][i]
+				} else {
+					line[j] = q.modules[i][j]
+				}
+			}
+			// 规则一: 连续 5 个及以上同色模块
+			run := 1
+			for j := 1; j <= q.size; j++ {
+				if j < q.size && line[j] == line[j-1] {
+					run++
+					continue
+				}
+				if run >= 5 {
+					result += run - 2
+				}
+				run = 1
+			}
+			// 规则三: 类似定位图形的序列
+			for j := 0; j+len(finderLike[0]) <= q.size; j++ {
+				for _, pattern := range finderLike {
+					if equalModules(line[j:j+len(pattern)], pattern) {
+						result += 40
+					}
+				}
+			}
+		}
+	}
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			// 规则二: 2x2 的同色块
+			if x+1 < q.size && y+1 < q.size {
+				c := q.modules[y][x]
+				if c == q.modules[y][x+1] && c == q.modules[y+1][x] && c == q.modules[y+1][x+1] {
+					result += 3
+				}
+			}
+			if q.modules[y][x] {
+				dark++
+			}
+		}
+	}
+	// 规则四: 深色模块占比偏离 50%
+	total := q.size * q.size
+	result += abs(dark*20-total*10) / total * 10
+	return result
+}
+
+func equalModules(a, b []bool) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// chebyshevDistance 返回到图形中心的切比雪夫距离, 用于绘制同心的方形图形
+func chebyshevDistance(dx, dy int) int {
+	if abs(dx) > abs(dy) {
+		return abs(dx)
+	}
+	return abs(dy)
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,95 @@
+package openwechat
+
+import (
+	"bytes"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestReedSolomonRemainder(t *testing.T) {
+	// "HELLO WORLD" 以字母数字模式编码, 版本 1-M
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	expect := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := reedSolomonRemainder(data, reedSolomonDivisor(len(expect))); !bytes.Equal(got, expect) {
+		t.Errorf("unexpected error correction codewords: %v", got)
+	}
+}
+
+func TestQrcodeFormatBits(t *testing.T) {
+	cases := map[QrcodeLevel]int{
+		QrcodeLevelL: 0b111011111000100,
+		QrcodeLevelM: 0b101010000010010,
+		QrcodeLevelQ: 0b011010101011111,
+		QrcodeLevelH: 0b001011010001001,
+	}
+	for level, expect := range cases {
+		if got := qrcodeFormatBits(level, 0); got != expect {
+			t.Errorf("level %d: expect %015b, got %015b", level, expect, got)
+		}
+	}
+}
+
+func TestNewLoginQrcode(t *testing.T) {
+	code, err := NewLoginQrcode("QcF1gyZ7Gw==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 42 字节的内容在 M 等级下需要版本 3
+	if code.Size() != 29 {
+		t.Errorf("expect size 29, got %d", code.Size())
+	}
+	// 左上角的定位图形
+	for i := 0; i < 7; i++ {
+		if !code.Dark(i, 0) || !code.Dark(0, i) || code.Dark(i, 7) {
+			t.Fatal("unexpected finder pattern")
+		}
+	}
+	if _, err = NewQrcode(strings.Repeat("a", 300), QrcodeLevelM); err != ErrQrcodeContentTooLong {
+		t.Errorf("expect ErrQrcodeContentTooLong, got %v", err)
+	}
+}
+
+func TestTerminalQrcodeCallback(t *testing.T) {
+	var buf bytes.Buffer
+	TerminalQrcodeCallback(&buf)("QcF1gyZ7Gw==")
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")[1:]
+	// 29 个模块加上上下各 2 个模块的静区, 每行字符表示两个模块
+	if len(lines) != 17 {
+		t.Errorf("expect 17 lines, got %d", len(lines))
+	}
+	for _, line := range lines {
+		if utf8.RuneCountInString(line) != 33 {
+			t.Fatalf("unexpected line width: %q", line)
+		}
+	}
+}
+
+func TestFileQrcodeCallback(t *testing.T) {
+	dir := t.TempDir()
+	FileQrcodeCallback(filepath.Join(dir, "qrcode.png"))("QcF1gyZ7Gw==")
+	file, err := os.Open(filepath.Join(dir, "qrcode.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = file.Close() }()
+	img, err := png.Decode(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Dx(); size != (29+8)*8 {
+		t.Errorf("unexpected image size: %d", size)
+	}
+
+	FileQrcodeCallback(filepath.Join(dir, "qrcode.svg"))("QcF1gyZ7Gw==")
+	content, err := os.ReadFile(filepath.Join(dir, "qrcode.svg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(content, []byte("<svg")) {
+		t.Errorf("unexpected svg content: %s", content)
+	}
+}
@@ -0,0 +1,172 @@
+package openwechat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RetryPolicy 决定一次失败的请求是否需要重试
+type RetryPolicy interface {
+	// Backoff 在第 attempt 次请求失败之后调用, attempt 从 1 开始
+	// err 为网络错误或者 *APIError, 返回重试之前需要等待的时间, 返回 false 时不再重试
+	Backoff(req *http.Request, attempt int, err error) (time.Duration, bool)
+}
+
+// RetryPolicyFunc 将函数转换为 RetryPolicy
+type RetryPolicyFunc func(req *http.Request, attempt int, err error) (time.Duration, bool)
+
+// Backoff 实现了 RetryPolicy 接口
+func (f RetryPolicyFunc) Backoff(req *http.Request, attempt int, err error) (time.Duration, bool) {
+	return f(req, attempt, err)
+}
+
+// nonIdempotentEndpoints 重复请求会产生副作用的接口, 如重复发送消息
+var nonIdempotentEndpoints = map[string]bool{
+	endpointName(webwxsendmsg):        true,
+	endpointName(webwxsendemoticon):   true,
+	endpointName(webwxsendmsgimg):     true,
+	endpointName(webwxsendappmsg):     true,
+	endpointName(webwxsendvideomsg):   true,
+	endpointName(webwxcreatechatroom): true,
+	endpointName(webwxpushloginurl):   true,
+}
+
+// BackoffRetryPolicy 指数退避并且带有随机抖动的重试策略
+// 默认只重试 IsRetryable 的错误, 发送消息等非幂等的接口不会重试, 除非在 Endpoints 中为它设置了 AllowNonIdempotent 的策略
+//
+//	client.RetryPolicy = &openwechat.BackoffRetryPolicy{
+//		MaxAttempts: 5,
+//		Endpoints: map[string]openwechat.RetryPolicy{
+//			"webwxsendmsg": &openwechat.BackoffRetryPolicy{MaxAttempts: 2, AllowNonIdempotent: true},
+//		},
+//	}
+type BackoffRetryPolicy struct {
+	// MaxAttempts 最多请求的次数, 包含第一次请求, 为零时为 3
+	MaxAttempts int
+
+	// BaseDelay 第一次重试之前等待的时间, 之后每次翻倍, 为零时为 500 毫秒
+	BaseDelay time.Duration
+
+	// MaxDelay 最长的等待时间, 为零时为 10 秒
+	MaxDelay time.Duration
+
+	// Jitter 等待时间随机浮动的比例, 0.2 表示在 ±20% 之间浮动, 为零时不浮动
+	Jitter float64
+
+	// Retryable 判断错误是否可以重试, 为空时使用 IsRetryable
+	Retryable func(err error) bool
+
+	// AllowNonIdempotent 是否允许重试发送消息等非幂等的接口
+	AllowNonIdempotent bool
+
+	// Endpoints 按照接口名称覆盖的策略, 接口名称为接口路径的最后一段, 如 webwxsync
+	Endpoints map[string]RetryPolicy
+}
+
+// NewBackoffRetryPolicy 创建一个最多请求 maxAttempts 次的 BackoffRetryPolicy, 等待时间带有 20% 的随机浮动
+func NewBackoffRetryPolicy(maxAttempts int) *BackoffRetryPolicy {
+	return &BackoffRetryPolicy{MaxAttempts: maxAttempts, Jitter: 0.2}
+}
+
+// Backoff 实现了 RetryPolicy 接口
+func (p *BackoffRetryPolicy) Backoff(req *http.Request, attempt int, err error) (time.Duration, bool) {
+	endpoint := endpointName(req.URL.Path)
+	if policy, exist := p.Endpoints[endpoint]; exist {
+		return policy.Backoff(req, attempt, err)
+	}
+	if nonIdempotentEndpoints[endpoint] && !p.AllowNonIdempotent {
+		return 0, false
+	}
+	maxAttempts := p.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 3
+	}
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+	if attempt >= maxAttempts || !retryable(err) {
+		return 0, false
+	}
+	return p.delay(attempt), true
+}
+
+// delay 返回第 attempt 次请求失败之后需要等待的时间
+func (p *BackoffRetryPolicy) delay(attempt int) time.Duration {
+	base, maxDelay := p.BaseDelay, p.MaxDelay
+	if base <= 0 {
+		base = 500 * time.Millisecond
+	}
+	if maxDelay <= 0 {
+		maxDelay = 10 * time.Second
+	}
+	delay := base
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	if p.Jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(delay))
+	}
+	return delay
+}
+
+// maxRetryTimesPolicy 没有设置 RetryPolicy 时的行为, 只在网络错误和 5xx 时立即重试
+type maxRetryTimesPolicy int
+
+func (m maxRetryTimesPolicy) Backoff(_ *http.Request, attempt int, err error) (time.Duration, bool) {
+	return 0, attempt < int(m) && IsNetworkError(err)
+}
+
+// sleepContext 等待 d 或者 ctx 被取消
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// maxPeekSize 查找 BaseResponse 时最多读取的响应体大小
+const maxPeekSize = 1 << 20
+
+// peekAPIError 在不消耗响应体的情况下查找 BaseResponse 中的错误码
+// 只检查文本和 json 格式的响应, 文件下载等接口不受影响
+func peekAPIError(resp *http.Response) *APIError {
+	contentType := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "text/") && !strings.Contains(contentType, "json") {
+		return nil
+	}
+	head, err := io.ReadAll(io.LimitReader(resp.Body, maxPeekSize))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), resp.Body), resp.Body}
+	if err != nil {
+		return nil
+	}
+	var item struct{ BaseResponse *BaseResponse }
+	if json.Unmarshal(head, &item) != nil || item.BaseResponse == nil || item.BaseResponse.Ok() {
+		return nil
+	}
+	return &APIError{
+		Endpoint:   endpointName(resp.Request.URL.Path),
+		Ret:        item.BaseResponse.Ret,
+		ErrMsg:     item.BaseResponse.ErrMsg,
+		StatusCode: resp.StatusCode,
+	}
+}
@@ -1,8 +1,83 @@
 package openwechat
 
+import (
+	"time"
+)
+
 // Session 会话信息，包含登录信息、请求信息、响应信息
 type Session struct {
 	LoginInfo *LoginInfo
 	Request   *BaseRequest
 	Response  *WebInitResponse
 }
+
+// SessionInfo 描述了当前会话的健康状况, 用于预测会话何时失效
+type SessionInfo struct {
+	LoginTime      time.Time      // 最近一次登录成功的时间
+	LastSyncTime   time.Time      // 最近一次同步检查成功的时间
+	CookieExpiries []CookieExpiry // 记录了过期时间的 cookie, 从早到晚排序
+	HasDataTicket  bool           // 是否存在 webwx_data_ticket, 不存在时无法上传文件
+}
+
+// ExpiresAt 返回最早过期的 cookie 的过期时间, 没有记录时返回零值
+func (s SessionInfo) ExpiresAt() time.Time {
+	if len(s.CookieExpiries) == 0 {
+		return time.Time{}
+	}
+	return s.CookieExpiries[0].Expires
+}
+
+// sessionCookieNames 会话依赖的 cookie, 其中任何一个过期之后都需要重新登录
+var sessionCookieNames = []string{"wxsid", "webwx_data_ticket", "webwx_auth_ticket"}
+
+// SessionExpiresAt 返回会话 cookie (wxsid, webwx_data_ticket, webwx_auth_ticket) 中最早的过期时间, 没有记录时返回零值
+// 其他 cookie 如 mm_lang 过期不会影响会话
+func (s SessionInfo) SessionExpiresAt() time.Time {
+	for _, expiry := range s.CookieExpiries {
+		for _, name := range sessionCookieNames {
+			if expiry.Name == name {
+				return expiry.Expires
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// sessionRefreshRetryInterval 两次刷新会话之间的最小间隔
+const sessionRefreshRetryInterval = time.Minute
+
+// SessionRefresher 在会话 cookie 过期之前主动使用免扫码登录刷新会话, 见 SessionInfo.SessionExpiresAt
+// 刷新时会向手机发送确认登录的请求, 在消息同步的间隙中执行, 等待确认期间不会同步消息
+type SessionRefresher struct {
+	// Before 在最早的会话 cookie 过期之前多久开始刷新
+	Before time.Duration
+
+	// Timeout 等待手机确认登录的超时时间, 为零时不限制
+	Timeout time.Duration
+
+	// Callback 每次刷新完成之后的回调, err 为 nil 表示刷新成功
+	Callback func(info SessionInfo, err error)
+
+	lastAttempt time.Time
+}
+
+// refresh 判断会话是否即将过期, 如果是则执行免扫码登录
+func (r *SessionRefresher) refresh(bot *Bot) {
+	expiresAt := bot.SessionInfo().SessionExpiresAt()
+	if expiresAt.IsZero() || time.Until(expiresAt) > r.Before {
+		return
+	}
+	if time.Since(r.lastAttempt) < sessionRefreshRetryInterval {
+		return
+	}
+	r.lastAttempt = time.Now()
+	err := loginWithContext(bot.Context(), bot, botLoginFunc((&PushLogin{}).push), r.Timeout)
+	if r.Callback != nil {
+		r.Callback(bot.SessionInfo(), err)
+	}
+}
+
+// WithSessionRefresher 是一个 BotPreparerFunc，用于开启会话的主动刷新
+func WithSessionRefresher(refresher *SessionRefresher) BotPreparer {
+	return BotPreparerFunc(func(b *Bot) { b.sessionRefresher = refresher })
+}
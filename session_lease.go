@@ -0,0 +1,291 @@
+package openwechat
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// LeaseOwner 记录了持有会话租约的进程
+type LeaseOwner struct {
+	ID        string    `json:"id"`
+	PID       int       `json:"pid"`
+	Hostname  string    `json:"hostname"`
+	Heartbeat time.Time `json:"heartbeat"`
+	// Locked 持有者是否拿到了文件锁, 接管过期租约的进程在原进程释放文件锁之前为 false
+	Locked bool `json:"locked"`
+}
+
+// Stale 判断持有者的心跳是否已经超过了 ttl
+func (o LeaseOwner) Stale(ttl time.Duration) bool {
+	return time.Since(o.Heartbeat) > ttl
+}
+
+func (o LeaseOwner) String() string {
+	return fmt.Sprintf("pid %d on %s, last heartbeat at %s", o.PID, o.Hostname, o.Heartbeat.Format(time.RFC3339))
+}
+
+// SessionLease 跨进程的会话租约, 防止多个进程使用同一份热存储数据同时同步消息
+// 租约由锁文件上的 flock 和定时写入的心跳组成, 进程退出之后文件锁会自动释放
+// 持有文件锁但是心跳超时的进程被认为已经失去响应, 开启 TakeOver 之后可以接管它的租约
+type SessionLease struct {
+	// Path 锁文件的路径, 为空时使用热存储的文件名加上 .lock 后缀
+	Path string
+
+	// TTL 心跳的超时时间, 为零时为 30 秒, 每隔 TTL/3 写入一次心跳
+	TTL time.Duration
+
+	// TakeOver 是否接管心跳已经超时的租约, 被接管的进程会以 ErrSessionLeaseLost 退出
+	TakeOver bool
+
+	mu    sync.Mutex
+	file  *os.File
+	owner LeaseOwner
+	done  chan struct{}
+	lost  chan struct{}
+}
+
+// NewSessionLease 创建一个使用 path 作为锁文件的 SessionLease
+func NewSessionLease(path string) *SessionLease {
+	return &SessionLease{Path: path}
+}
+
+func (l *SessionLease) ttl() time.Duration {
+	if l.TTL > 0 {
+		return l.TTL
+	}
+	return 30 * time.Second
+}
+
+// Acquire 获取租约, 其他存活的进程持有租约时返回 ErrSessionLocked
+// 获取之后会在后台定时写入心跳, 直到调用 Release
+func (l *SessionLease) Acquire() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		return nil
+	}
+	if l.Path == "" {
+		return errors.New("session lease path is empty")
+	}
+	file, err := os.OpenFile(l.Path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	locked, err := lockFile(file)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = l.check(locked); err != nil {
+		if locked {
+			_ = unlockFile(file)
+		}
+		_ = file.Close()
+		return err
+	}
+	l.file = file
+	l.owner = newLeaseOwner(locked)
+	if err = l.write(); err != nil {
+		l.close()
+		return err
+	}
+	l.done, l.lost = make(chan struct{}), make(chan struct{})
+	go l.heartbeat(l.done)
+	return nil
+}
+
+// check 判断锁文件中记录的持有者是否还存活
+func (l *SessionLease) check(locked bool) error {
+	owner, err := l.Owner()
+	if err != nil {
+		return err
+	}
+	// 没有可读的持有者, 如持有者正在写入心跳, 是否存活只能由文件锁决定
+	if owner.ID == "" {
+		if !locked && flockSupported {
+			return fmt.Errorf("%w: lock file is held by another process", ErrSessionLocked)
+		}
+		return nil
+	}
+	// 拿到了文件锁, 之前持有文件锁的进程已经退出
+	if locked && owner.Locked {
+		return nil
+	}
+	// 心跳还在的持有者还存活, 拿到了文件锁时说明它接管了租约但是还没有拿到文件锁
+	if !owner.Stale(l.ttl()) {
+		return fmt.Errorf("%w: %s", ErrSessionLocked, owner)
+	}
+	if !locked && !l.TakeOver {
+		return fmt.Errorf("%w: lease is stale, %s", ErrSessionLocked, owner)
+	}
+	return nil
+}
+
+// Owner 读取锁文件中记录的持有者, 没有持有者时返回零值
+func (l *SessionLease) Owner() (LeaseOwner, error) {
+	var owner LeaseOwner
+	data, err := os.ReadFile(l.Path)
+	if os.IsNotExist(err) || len(data) == 0 {
+		return owner, nil
+	}
+	if err != nil {
+		return owner, err
+	}
+	// 内容损坏时当作没有持有者, 是否存活由文件锁决定
+	_ = json.Unmarshal(data, &owner)
+	return owner, nil
+}
+
+// Held 判断当前进程是否持有租约
+func (l *SessionLease) Held() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file != nil
+}
+
+// Lost 返回一个 channel, 租约被其他进程接管时关闭
+func (l *SessionLease) Lost() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lost
+}
+
+// Release 停止心跳并释放租约
+func (l *SessionLease) Release() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	// 租约已经被接管时不能清空新持有者的记录
+	var err error
+	if owner, _ := l.Owner(); owner.ID == l.owner.ID {
+		err = l.file.Truncate(0)
+	}
+	l.close()
+	return err
+}
+
+// close 关闭锁文件并停止心跳, 调用时必须持有锁
+func (l *SessionLease) close() {
+	if l.owner.Locked {
+		_ = unlockFile(l.file)
+	}
+	_ = l.file.Close()
+	l.file = nil
+	if l.done != nil {
+		close(l.done)
+		l.done = nil
+	}
+}
+
+// write 将当前的持有者写入锁文件, 调用时必须持有锁
+// 先覆盖再截断, 其他进程任何时候都不会读到空的锁文件
+func (l *SessionLease) write() error {
+	data, err := json.Marshal(l.owner)
+	if err != nil {
+		return err
+	}
+	if _, err = l.file.WriteAt(data, 0); err != nil {
+		return err
+	}
+	return l.file.Truncate(int64(len(data)))
+}
+
+func (l *SessionLease) heartbeat(done chan struct{}) {
+	ticker := time.NewTicker(l.ttl() / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if !l.beat(done) {
+			return
+		}
+	}
+}
+
+// beat 写入一次心跳, 返回是否还持有租约
+func (l *SessionLease) beat(done chan struct{}) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.done != done {
+		return false
+	}
+	if owner, err := l.Owner(); err == nil && owner.ID != "" && owner.ID != l.owner.ID {
+		close(l.lost)
+		l.close()
+		return false
+	}
+	// 接管的租约在原进程释放文件锁之后补上文件锁
+	if !l.owner.Locked {
+		l.owner.Locked, _ = lockFile(l.file)
+	}
+	l.owner.Heartbeat = time.Now()
+	_ = l.write()
+	return true
+}
+
+func newLeaseOwner(locked bool) LeaseOwner {
+	hostname, _ := os.Hostname()
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return LeaseOwner{
+		ID:        hex.EncodeToString(id),
+		PID:       os.Getpid(),
+		Hostname:  hostname,
+		Heartbeat: time.Now(),
+		Locked:    locked,
+	}
+}
+
+// storageName 返回 storage 的名称, 如文件存储的文件名
+func storageName(storage HotReloadStorage) (string, bool) {
+	if named, ok := storage.(interface{ Name() string }); ok && named.Name() != "" {
+		return named.Name(), true
+	}
+	return "", false
+}
+
+// holdSessionLease 在读取热存储数据之前获取会话租约, 已经持有时不做任何操作
+// 租约会在 bot 退出时释放, 被其他进程接管时 bot 以 ErrSessionLeaseLost 退出
+func (b *Bot) holdSessionLease(storage HotReloadStorage) error {
+	lease := b.sessionLease
+	if lease == nil || lease.Held() {
+		return nil
+	}
+	if lease.Path == "" {
+		name, ok := storageName(storage)
+		if !ok {
+			return errors.New("session lease path is empty and storage has no name")
+		}
+		lease.Path = name + ".lock"
+	}
+	if err := lease.Acquire(); err != nil {
+		return err
+	}
+	go func(lost <-chan struct{}) {
+		select {
+		case <-b.Context().Done():
+			_ = lease.Release()
+		case <-lost:
+			b.ExitWith(ErrSessionLeaseLost)
+		}
+	}(lease.Lost())
+	return nil
+}
+
+// WithSessionLease 是一个 BotPreparerFunc，用于在热登录和免扫码登录时获取跨进程的会话租约
+//
+//	bot := openwechat.DefaultBot(openwechat.WithSessionLease(&openwechat.SessionLease{TakeOver: true}))
+func WithSessionLease(lease *SessionLease) BotPreparer {
+	return BotPreparerFunc(func(b *Bot) { b.sessionLease = lease })
+}
@@ -0,0 +1,25 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package openwechat
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// flockSupported 当前平台支持 flock, 文件锁可以判断持有者是否存活
+const flockSupported = true
+
+// lockFile 尝试对文件加上排他的 flock, 不会阻塞, 返回是否拿到了文件锁
+func lockFile(file *os.File) (bool, error) {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
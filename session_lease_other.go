@@ -0,0 +1,19 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package openwechat
+
+import (
+	"os"
+)
+
+// flockSupported 当前平台不支持 flock
+const flockSupported = false
+
+// lockFile 当前平台不支持 flock, 租约只依赖心跳判断持有者是否存活
+func lockFile(*os.File) (bool, error) {
+	return false, nil
+}
+
+func unlockFile(*os.File) error {
+	return nil
+}
@@ -0,0 +1,107 @@
+package openwechat
+
+import (
+	"errors"
+	"time"
+)
+
+// HotReloadStatus 描述了一份热存储数据是否还可以用于登录
+type HotReloadStatus struct {
+	SavedAt        time.Time          // 数据的保存时间, 旧格式的数据为零值
+	Mode           string             // 保存数据时使用的模式
+	Domain         WechatDomain       // 会话所在的域名
+	Uin            int64              // 账号的 uin
+	CookieExpiries []CookieExpiry     // 记录了过期时间的 cookie, 从早到晚排序
+	HasDataTicket  bool               // 是否存在 webwx_data_ticket, 不存在时无法上传文件
+	SyncCheck      *SyncCheckResponse // 同步检查的结果, 请求失败时为 nil
+	SyncCheckErr   error              // 同步检查的错误, 如 cookie 失效
+	User           *User              // WebInit 返回的当前用户, 失败或者没有执行时为 nil
+	WebInitErr     error              // WebInit 的错误, 同步检查失败时不会执行 WebInit
+}
+
+// Usable 判断会话是否还可以使用
+func (s HotReloadStatus) Usable() bool {
+	return s.Err() == nil
+}
+
+// Err 返回导致会话不可用的错误
+func (s HotReloadStatus) Err() error {
+	return errors.Join(s.SyncCheckErr, s.WebInitErr)
+}
+
+// ExpiresAt 返回最早过期的 cookie 的过期时间, 没有记录时返回零值
+func (s HotReloadStatus) ExpiresAt() time.Time {
+	if len(s.CookieExpiries) == 0 {
+		return time.Time{}
+	}
+	return s.CookieExpiries[0].Expires
+}
+
+// ProbeHotReload 使用 storage 中的会话执行一次同步检查和 WebInit, 判断会话是否还可以使用
+// 不会修改 bot 的会话, 不会通知手机, 不会启动消息同步, 也不会写入 storage
+// 读取 storage 失败时返回错误, 会话不可用时通过 HotReloadStatus.Err 获取原因
+//
+//	status, err := bot.ProbeHotReload(openwechat.NewFileHotReloadStorage("storage.json"))
+//	if err == nil && status.Usable() {
+//		fmt.Println(status.User.NickName, status.ExpiresAt())
+//	}
+func (b *Bot) ProbeHotReload(storage HotReloadStorage) (*HotReloadStatus, error) {
+	if storage == nil {
+		return nil, errors.New("storage is nil")
+	}
+	envelope, item, err := loadHotReloadItem(storage, b.hotReloadMaxAge)
+	if err != nil {
+		return nil, err
+	}
+	_, hasDataTicket := item.Jar.AllCookies().GetByName("webwx_data_ticket")
+	status := &HotReloadStatus{
+		SavedAt:        envelope.SavedAt,
+		Mode:           envelope.Mode,
+		Domain:         item.WechatDomain,
+		Uin:            item.LoginInfo.WxUin,
+		CookieExpiries: item.Jar.Expiries(),
+		HasDataTicket:  hasDataTicket,
+	}
+	caller := b.probeCaller(item.Jar, item.WechatDomain)
+	ctx := b.Context()
+
+	response := &WebInitResponse{SyncKey: item.SyncKey}
+	if response.SyncKey == nil {
+		response.SyncKey = &SyncKey{}
+	}
+	status.SyncCheck, status.SyncCheckErr = caller.SyncCheck(ctx, &CallerSyncCheckOptions{
+		BaseRequest:     item.BaseRequest,
+		WebInitResponse: response,
+		LoginInfo:       item.LoginInfo,
+	})
+	if status.SyncCheckErr == nil {
+		status.SyncCheckErr = status.SyncCheck.Err()
+	}
+	if status.SyncCheckErr != nil {
+		return status, nil
+	}
+	resp, err := caller.WebInit(ctx, item.BaseRequest)
+	if err != nil {
+		status.WebInitErr = err
+		return status, nil
+	}
+	status.User = resp.User
+	return status, nil
+}
+
+// probeCaller 使用 bot 的模式和钩子创建一个独立的 Caller, 请求不会影响 bot 的 cookie 和域名
+func (b *Bot) probeCaller(jar *Jar, domain WechatDomain) *Caller {
+	current := b.Caller.Client
+	httpClient := *current.HTTPClient()
+	client := &Client{
+		mode:          current.mode,
+		modeName:      current.modeName,
+		client:        &httpClient,
+		domain:        domain,
+		HttpHooks:     current.HttpHooks,
+		MaxRetryTimes: current.MaxRetryTimes,
+		RetryPolicy:   current.RetryPolicy,
+	}
+	client.SetCookieJar(jar)
+	return NewCaller(client)
+}
@@ -0,0 +1,41 @@
+package openwechat
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSessionRefresherIgnoresStaleCookies(t *testing.T) {
+	bot := NewBot(context.Background())
+	defer bot.Exit()
+	jar := bot.Caller.Client.Jar()
+	u, _ := url.Parse("https://wx.qq.com/")
+	jar.SetCookies(u, []*http.Cookie{
+		{Name: "wxsid", Value: "sid", Domain: "wx.qq.com", Expires: time.Now().Add(12 * time.Hour)},
+		{Name: "mm_lang", Value: "zh_CN", Domain: "wx.qq.com", Expires: time.Now().Add(time.Hour)},
+	})
+	// 模拟已经过期的非会话 cookie, 以及已经被 cookiejar.Jar 丢弃的 cookie
+	jar.mu.Lock()
+	key := cookieKey{Domain: "wx.qq.com", Name: "mm_lang"}
+	entry := jar.entries[key]
+	entry.Expires = time.Now().Add(-time.Minute)
+	jar.entries[key] = entry
+	jar.entries[cookieKey{Domain: "wx.qq.com", Name: "dropped"}] = cookieEntry{Path: "/", Expires: time.Now().Add(time.Minute)}
+	jar.mu.Unlock()
+
+	if expiries := jar.Expiries(); len(expiries) != 1 || expiries[0].Name != "wxsid" {
+		t.Errorf("expect only wxsid, got %+v", expiries)
+	}
+	var refreshed bool
+	refresher := &SessionRefresher{
+		Before:   time.Hour,
+		Callback: func(SessionInfo, error) { refreshed = true },
+	}
+	refresher.refresh(bot)
+	if refreshed {
+		t.Error("expect no refresh while the session cookies are valid")
+	}
+}
@@ -1,8 +1,13 @@
 package openwechat
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"sync"
 )
 
@@ -61,6 +66,16 @@ func (j *fileHotReloadStorage) Write(p []byte) (n int, err error) {
 	return j.file.Write(p)
 }
 
+// Seek 用于重复读取, 文件还未打开时不做任何操作
+func (j *fileHotReloadStorage) Seek(offset int64, whence int) (int64, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.file == nil {
+		return 0, nil
+	}
+	return j.file.Seek(offset, whence)
+}
+
 func (j *fileHotReloadStorage) Close() error {
 	j.lock.Lock()
 	defer j.lock.Unlock()
@@ -70,6 +85,11 @@ func (j *fileHotReloadStorage) Close() error {
 	return j.file.Close()
 }
 
+// Name 返回存储的文件名, 用于确定 SessionLease 的锁文件
+func (j *fileHotReloadStorage) Name() string {
+	return j.filename
+}
+
 // Deprecated: use NewFileHotReloadStorage instead
 // 不再单纯以json的格式存储，支持了用户自定义序列化方式
 func NewJsonFileHotReloadStorage(filename string) io.ReadWriteCloser {
@@ -80,3 +100,131 @@ func NewJsonFileHotReloadStorage(filename string) io.ReadWriteCloser {
 func NewFileHotReloadStorage(filename string) io.ReadWriteCloser {
 	return &fileHotReloadStorage{filename: filename}
 }
+
+// atomicFileHotReloadStorage 实现HotReloadStorage接口
+// 先写入临时文件并同步到磁盘, 再通过重命名替换原文件, 避免写到一半时崩溃导致数据损坏
+// 同时保留最近的 generations 份数据, 依次为 filename, filename.1, filename.2 ...
+type atomicFileHotReloadStorage struct {
+	filename    string
+	generations int
+	reader      *bytes.Reader
+	lock        sync.Mutex
+}
+
+// Read 第一次读取时从最新的一份数据开始查找, 返回第一份有效的数据
+func (a *atomicFileHotReloadStorage) Read(p []byte) (n int, err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.reader == nil {
+		data, err := a.load()
+		if err != nil {
+			return 0, err
+		}
+		a.reader = bytes.NewReader(data)
+	}
+	return a.reader.Read(p)
+}
+
+func (a *atomicFileHotReloadStorage) load() ([]byte, error) {
+	var found bool
+	for i := 0; i < a.generations; i++ {
+		data, err := os.ReadFile(a.generation(i))
+		if os.IsNotExist(err) {
+			continue
+		}
+		found = true
+		if err == nil && validHotReloadData(data) {
+			return data, nil
+		}
+	}
+	if !found {
+		return nil, ErrInvalidStorage
+	}
+	return nil, errors.Join(ErrInvalidStorage, fmt.Errorf("no valid hot reload data in %s", a.filename))
+}
+
+// validHotReloadData 判断数据是否完整, 支持 json 和加密之后的格式
+func validHotReloadData(data []byte) bool {
+	if bytes.HasPrefix(data, []byte(encryptedStorageMagic)) {
+		return validEncryptedData(data)
+	}
+	return len(bytes.TrimSpace(data)) > 0 && json.Valid(data)
+}
+
+// Write 每次写入的数据都被视为一份完整的快照
+func (a *atomicFileHotReloadStorage) Write(p []byte) (n int, err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	dir := filepath.Dir(a.filename)
+	file, err := os.CreateTemp(dir, filepath.Base(a.filename)+".tmp*")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(file.Name())
+		}
+	}()
+	if _, err = file.Write(p); err == nil {
+		err = file.Sync()
+	}
+	if err = errors.Join(err, file.Close()); err != nil {
+		return 0, err
+	}
+	// 从最旧的开始依次后移, 最旧的一份会被覆盖
+	for i := a.generations - 1; i > 0; i-- {
+		if err = os.Rename(a.generation(i-1), a.generation(i)); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+	if err = os.Rename(file.Name(), a.filename); err != nil {
+		return 0, err
+	}
+	syncDir(dir)
+	a.reader = nil
+	return len(p), nil
+}
+
+// Seek 用于重复读取, 下一次读取时会重新从文件中加载
+func (a *atomicFileHotReloadStorage) Seek(offset int64, whence int) (int64, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if offset != 0 || whence != io.SeekStart {
+		return 0, errors.New("atomic file storage only supports seeking to start")
+	}
+	a.reader = nil
+	return 0, nil
+}
+
+func (a *atomicFileHotReloadStorage) Close() error {
+	return nil
+}
+
+// Name 返回存储的文件名, 用于确定 SessionLease 的锁文件
+func (a *atomicFileHotReloadStorage) Name() string {
+	return a.filename
+}
+
+func (a *atomicFileHotReloadStorage) generation(i int) string {
+	if i == 0 {
+		return a.filename
+	}
+	return fmt.Sprintf("%s.%d", a.filename, i)
+}
+
+// syncDir 将目录同步到磁盘, 保证重命名已经持久化, 部分平台不支持, 忽略错误
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		_ = d.Close()
+	}
+}
+
+// NewAtomicFileHotReloadStorage implements HotReloadStorage
+// 以原子替换的方式写入文件, 并保留最近的 generations 份数据, 读取时会跳过损坏的数据
+func NewAtomicFileHotReloadStorage(filename string, generations int) io.ReadWriteCloser {
+	if generations < 1 {
+		generations = 1
+	}
+	return &atomicFileHotReloadStorage{filename: filename, generations: generations}
+}
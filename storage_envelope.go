@@ -0,0 +1,157 @@
+package openwechat
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"runtime/debug"
+	"time"
+)
+
+// hotReloadFormatVersion 当前热存储数据的格式版本
+const hotReloadFormatVersion = 1
+
+// HotReloadEnvelope 热存储数据的外层结构
+// 记录了数据的格式版本, 保存时间和校验和, 用于在读取时校验数据并兼容旧的格式
+type HotReloadEnvelope struct {
+	Version    int             // 数据格式版本
+	SavedAt    time.Time       // 保存时间, 旧格式迁移过来的数据为零值
+	LibVersion string          // 保存数据的 openwechat 版本
+	Mode       string          // 登录时使用的模式
+	DeviceID   string          // 设备 id
+	Checksum   string          // Item 的 sha256 校验和
+	Item       json.RawMessage // HotReloadStorageItem
+}
+
+// hotReloadMigrations 将 key 对应版本的数据迁移到下一个版本
+var hotReloadMigrations = map[int]func(data []byte) (*HotReloadEnvelope, error){
+	// 版本 0 为没有外层结构, 直接保存 HotReloadStorageItem 的格式
+	0: func(data []byte) (*HotReloadEnvelope, error) {
+		return &HotReloadEnvelope{Version: 1, Item: data}, nil
+	},
+}
+
+// newHotReloadEnvelope 将 bot 当前的会话信息打包
+func newHotReloadEnvelope(bot *Bot, item HotReloadStorageItem) (*HotReloadEnvelope, error) {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return nil, err
+	}
+	return &HotReloadEnvelope{
+		Version:    hotReloadFormatVersion,
+		SavedAt:    time.Now(),
+		LibVersion: libraryVersion(),
+		Mode:       bot.Caller.Client.modeName,
+		DeviceID:   bot.deviceId,
+		Checksum:   hotReloadChecksum(data),
+		Item:       data,
+	}, nil
+}
+
+// decodeHotReloadEnvelope 读取并校验热存储数据, maxAge 大于零时会检查数据是否过期
+func decodeHotReloadEnvelope(reader io.Reader, maxAge time.Duration) (*HotReloadEnvelope, *HotReloadStorageItem, error) {
+	var data json.RawMessage
+	if err := json.NewDecoder(reader).Decode(&data); err != nil {
+		var syntaxError *json.SyntaxError
+		if errors.As(err, &syntaxError) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, nil, errors.Join(ErrHotReloadCorrupt, err)
+		}
+		return nil, nil, err
+	}
+	envelope, err := migrateHotReloadEnvelope(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if envelope.Checksum != "" && envelope.Checksum != hotReloadChecksum(envelope.Item) {
+		return nil, nil, fmt.Errorf("%w: checksum mismatch", ErrHotReloadCorrupt)
+	}
+	if maxAge > 0 && !envelope.SavedAt.IsZero() && time.Since(envelope.SavedAt) > maxAge {
+		return nil, nil, fmt.Errorf("%w: saved at %s", ErrHotReloadExpired, envelope.SavedAt.Format(time.RFC3339))
+	}
+	var item HotReloadStorageItem
+	if err = json.Unmarshal(envelope.Item, &item); err != nil {
+		return nil, nil, errors.Join(ErrHotReloadCorrupt, err)
+	}
+	return envelope, &item, nil
+}
+
+// migrateHotReloadEnvelope 识别数据的格式版本, 并依次迁移到当前版本
+func migrateHotReloadEnvelope(data []byte) (*HotReloadEnvelope, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, errors.Join(ErrHotReloadCorrupt, err)
+	}
+	var version int
+	if raw, exist := fields["Version"]; exist {
+		if err := json.Unmarshal(raw, &version); err != nil {
+			return nil, errors.Join(ErrHotReloadCorrupt, err)
+		}
+	}
+	if version > hotReloadFormatVersion {
+		return nil, fmt.Errorf("%w: %d", ErrHotReloadVersion, version)
+	}
+	if version == hotReloadFormatVersion {
+		var envelope HotReloadEnvelope
+		if err := json.Unmarshal(data, &envelope); err != nil {
+			return nil, errors.Join(ErrHotReloadCorrupt, err)
+		}
+		// 只有从旧版本迁移过来的数据没有校验和
+		if envelope.Checksum == "" {
+			return nil, fmt.Errorf("%w: missing checksum", ErrHotReloadCorrupt)
+		}
+		return &envelope, nil
+	}
+	for version < hotReloadFormatVersion {
+		migrate, exist := hotReloadMigrations[version]
+		if !exist {
+			return nil, fmt.Errorf("%w: no migration from %d", ErrHotReloadVersion, version)
+		}
+		envelope, err := migrate(data)
+		if err != nil {
+			return nil, err
+		}
+		if version = envelope.Version; version == hotReloadFormatVersion {
+			return envelope, nil
+		}
+		if data, err = json.Marshal(envelope); err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("%w: %d", ErrHotReloadVersion, version)
+}
+
+// hotReloadChecksum 计算压缩之后的 json 的校验和, 不受格式化的影响
+func hotReloadChecksum(data []byte) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		buf.Reset()
+		buf.Write(data)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	return hex.EncodeToString(sum[:])
+}
+
+// libraryVersion 返回当前使用的 openwechat 的版本, 未知时返回 (devel)
+func libraryVersion() string {
+	const path = "github.com/eatmoreapple/openwechat"
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "(devel)"
+	}
+	if info.Main.Path == path {
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == path {
+			if dep.Replace != nil {
+				return dep.Replace.Version
+			}
+			return dep.Version
+		}
+	}
+	return "(devel)"
+}
@@ -0,0 +1,85 @@
+package openwechat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAtomicFileHotReloadStorage(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "storage.json")
+	storage := NewAtomicFileHotReloadStorage(filename, 2)
+	if err := json.NewDecoder(storage).Decode(&HotReloadStorageItem{}); err != ErrInvalidStorage {
+		t.Errorf("expect ErrInvalidStorage for missing file, got %v", err)
+	}
+	for _, uuid := range []string{"first", "second", "third"} {
+		if err := json.NewEncoder(storage).Encode(HotReloadStorageItem{UUID: uuid}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(filename + ".2"); !os.IsNotExist(err) {
+		t.Error("expect only 2 generations")
+	}
+
+	var item HotReloadStorageItem
+	if err := json.NewDecoder(storage).Decode(&item); err != nil || item.UUID != "third" {
+		t.Fatalf("expect newest generation, got %v %v", item.UUID, err)
+	}
+
+	// 模拟写到一半时崩溃的文件
+	if err := os.WriteFile(filename, []byte(`{"UUID":"thi`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	storage = NewAtomicFileHotReloadStorage(filename, 2)
+	if err := json.NewDecoder(storage).Decode(&item); err != nil || item.UUID != "second" {
+		t.Errorf("expect fallback to previous generation, got %v %v", item.UUID, err)
+	}
+}
+
+func TestDecodeHotReloadEnvelope(t *testing.T) {
+	bot := NewBot(context.Background())
+	bot.deviceId = "e123456789012345"
+	envelope, err := newHotReloadEnvelope(bot, HotReloadStorageItem{UUID: "uuid"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, item, err := decodeHotReloadEnvelope(bytes.NewReader(data), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.UUID != "uuid" || got.DeviceID != bot.deviceId || got.Mode != "normal" {
+		t.Errorf("unexpected envelope: %+v", got)
+	}
+
+	// 旧版本直接保存 HotReloadStorageItem 的数据
+	if _, item, err = decodeHotReloadEnvelope(strings.NewReader(`{"UUID":"legacy"}`), time.Hour); err != nil || item.UUID != "legacy" {
+		t.Errorf("expect legacy data migrated, got %v %v", item, err)
+	}
+
+	cases := map[string]struct {
+		data   string
+		maxAge time.Duration
+		expect error
+	}{
+		"corrupt":  {data: string(data[:len(data)/2]), expect: ErrHotReloadCorrupt},
+		"checksum": {data: strings.Replace(string(data), `"UUID":"uuid"`, `"UUID":"hijack"`, 1), expect: ErrHotReloadCorrupt},
+		"missing":  {data: strings.Replace(string(data), `"Checksum":"`+envelope.Checksum+`",`, "", 1), expect: ErrHotReloadCorrupt},
+		"version":  {data: `{"Version":99}`, expect: ErrHotReloadVersion},
+		"expired":  {data: string(data), maxAge: time.Nanosecond, expect: ErrHotReloadExpired},
+	}
+	for name, c := range cases {
+		if _, _, err = decodeHotReloadEnvelope(strings.NewReader(c.data), c.maxAge); !errors.Is(err, c.expect) {
+			t.Errorf("%s: expect %v, got %v", name, c.expect, err)
+		}
+	}
+}
@@ -40,7 +40,7 @@ func (s SyncCheckResponse) Err() error {
 	if err != nil {
 		return errors.New("sync check unknown error")
 	}
-	return Ret(i)
+	return &APIError{Endpoint: endpointName(synccheck), Ret: Ret(i)}
 }
 
 func NewSyncCheckResponse(b []byte) (*SyncCheckResponse, error) {
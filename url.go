@@ -1,5 +1,7 @@
 package openwechat
 
+import "strings"
+
 //// mode 类型限制
 //type mode string
 //
@@ -40,18 +42,56 @@ const (
 	jslogin           = "https://login.wx.qq.com/jslogin"
 	login             = "https://login.wx.qq.com/cgi-bin/mmwebwx-bin/login"
 	qrcode            = "https://login.weixin.qq.com/qrcode/"
+	qrcodeContent     = "https://login.weixin.qq.com/l/"
 )
 
 type WechatDomain string
 
+// WechatDomains 微信网页版已知的所有域名
+// 登录之后会跳转到其中的一个, 同一个后缀下的域名可以共用同一个会话
+var WechatDomains = []WechatDomain{"wx.qq.com", "wx2.qq.com", "wx8.qq.com", "web.wechat.com", "web2.wechat.com"}
+
+// host 返回文件和消息同步服务所在的域名
+// 微信网页版也可能跳转到根域名, 这时使用根域名下默认的子域名
+func (w WechatDomain) host() string {
+	switch w {
+	case "qq.com":
+		return "wx.qq.com"
+	case "wechat.com":
+		return "web.wechat.com"
+	default:
+		return string(w)
+	}
+}
+
 func (w WechatDomain) BaseHost() string {
 	return "https://" + string(w)
 }
 
 func (w WechatDomain) FileHost() string {
-	return "https://file." + string(w)
+	return "https://file." + w.host()
 }
 
 func (w WechatDomain) SyncHost() string {
-	return "https://webpush." + string(w)
+	return "https://webpush." + w.host()
+}
+
+// suffix 返回域名所属的根域名, 如 qq.com, wechat.com
+func (w WechatDomain) suffix() string {
+	parts := strings.Split(string(w), ".")
+	if len(parts) <= 2 {
+		return string(w)
+	}
+	return strings.Join(parts[len(parts)-2:], ".")
+}
+
+// Alternatives 返回跟当前域名同属一个根域名的其他已知域名, 用于连接失败时切换
+func (w WechatDomain) Alternatives() []WechatDomain {
+	var domains []WechatDomain
+	for _, domain := range WechatDomains {
+		if domain.host() != w.host() && domain.suffix() == w.suffix() {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
 }
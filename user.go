@@ -309,6 +309,76 @@ func (s *Self) updateMembers() error {
 	return nil
 }
 
+// applyContactChanges 将 webwxsync 返回的联系人变更合并到缓存中, 返回变更对应的事件
+// 已有的联系人原地更新, 之前获取到的 *Friend 和 *Group 依然有效
+// 缓存还没有加载时不做处理, 第一次获取时会拉取完整的联系人列表
+func (s *Self) applyContactChanges(resp *WebWxSyncResponse) []*ContactEvent {
+	if s.members == nil {
+		return nil
+	}
+	changes := len(resp.ModContactList) + len(resp.ModChatRoomMemberList) + len(resp.DelContactList)
+	if changes == 0 {
+		return nil
+	}
+	var events []*ContactEvent
+	for _, user := range resp.ModContactList {
+		events = append(events, s.mergeMember(user)...)
+	}
+	for _, group := range resp.ModChatRoomMemberList {
+		events = append(events, s.mergeMember(group)...)
+	}
+	for _, user := range resp.DelContactList {
+		events = append(events, s.removeMember(user))
+	}
+	// 重新划分好友、群组和公众号, 没有加载过的分类等到获取时再划分
+	if s.friends != nil {
+		s.friends = s.members.Friends()
+	}
+	if s.groups != nil {
+		s.groups = s.members.Groups()
+	}
+	if s.mps != nil {
+		s.mps = s.members.MPs()
+	}
+	return events
+}
+
+// mergeMember 更新或者添加一个联系人
+func (s *Self) mergeMember(user *User) []*ContactEvent {
+	if user.UserName == "" || user.UserName == s.UserName {
+		return nil
+	}
+	user.self = s
+	user.formatEmoji()
+	user.MemberList.init(s)
+	for _, member := range s.members {
+		if member.UserName != user.UserName {
+			continue
+		}
+		// 没有带上群成员时保留原来的群成员
+		if len(user.MemberList) == 0 {
+			user.MemberList = member.MemberList
+		}
+		old := *member
+		*member = *user
+		return diffContact(&old, member)
+	}
+	s.members = append(s.members, user)
+	return []*ContactEvent{{Type: ContactAdded, Contact: user}}
+}
+
+// removeMember 从缓存中删除一个联系人, 缓存中没有时事件中的联系人只有 UserName
+func (s *Self) removeMember(user *User) *ContactEvent {
+	for index, member := range s.members {
+		if member.UserName == user.UserName {
+			s.members = append(s.members[:index:index], s.members[index+1:]...)
+			return &ContactEvent{Type: ContactRemoved, Contact: member}
+		}
+	}
+	user.self = s
+	return &ContactEvent{Type: ContactRemoved, Contact: user}
+}
+
 // FileHelper 获取文件传输助手对象，封装成Friend返回
 //
 //	fh := self.FileHelper() // or fh := openwechat.NewFriendHelper(self)